@@ -0,0 +1,38 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !plan9
+
+package http
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// isConnResetError reports whether err, a read or write error on a
+// network connection, is due to the peer resetting the connection.
+// EPIPE is not such an error: writing to a connection the peer closed
+// gracefully causes it too.
+func isConnResetError(err error) bool {
+	oe, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	se, ok := oe.Err.(*os.SyscallError)
+	if !ok {
+		return false
+	}
+	errno, ok := se.Err.(syscall.Errno)
+	if !ok {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		const WSAECONNRESET = 10054
+		return errno == WSAECONNRESET
+	}
+	return errno == syscall.ECONNRESET
+}
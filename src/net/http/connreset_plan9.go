@@ -0,0 +1,13 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+// isConnResetError reports whether err, a read or write error on a
+// network connection, is due to the peer resetting the connection.
+// Plan 9 reports connection errors as strings, which are not
+// recognized.
+func isConnResetError(err error) bool {
+	return false
+}
@@ -12,6 +12,7 @@ import (
 	"io"
 	"mime"
 	"mime/multipart"
+	"net/http/httptrace"
 	"net/textproto"
 	"net/url"
 	"os"
@@ -506,26 +507,50 @@ func writeNotModified(w ResponseWriter) {
 // checkPreconditions evaluates request preconditions and reports whether a precondition
 // resulted in sending StatusNotModified or StatusPreconditionFailed.
 func checkPreconditions(w ResponseWriter, r *Request, modtime time.Time) (done bool, rangeHeader string) {
+	// evaluated lists the precondition headers evaluated, and
+	// status the response they led to, for the trace.
+	var (
+		evaluated []string
+		status    int
+	)
+	if trace := traceHooks(httptrace.ContextServerTrace(r.Context()), httptrace.ResponseHooks); trace != nil && trace.ConditionalResult != nil {
+		defer func() {
+			if len(evaluated) > 0 {
+				trace.ConditionalResult(httptrace.ConditionalInfo{Evaluated: evaluated, StatusCode: status})
+			}
+		}()
+	}
+	eval := func(header string, ch condResult) condResult {
+		if ch != condNone {
+			evaluated = append(evaluated, header)
+		}
+		return ch
+	}
+
 	// This function carefully follows RFC 7232 section 6.
-	ch := checkIfMatch(w, r)
+	ch := eval("If-Match", checkIfMatch(w, r))
 	if ch == condNone {
-		ch = checkIfUnmodifiedSince(r, modtime)
+		ch = eval("If-Unmodified-Since", checkIfUnmodifiedSince(r, modtime))
 	}
 	if ch == condFalse {
-		w.WriteHeader(StatusPreconditionFailed)
+		status = StatusPreconditionFailed
+		w.WriteHeader(status)
 		return true, ""
 	}
-	switch checkIfNoneMatch(w, r) {
+	switch eval("If-None-Match", checkIfNoneMatch(w, r)) {
 	case condFalse:
 		if r.Method == "GET" || r.Method == "HEAD" {
+			status = StatusNotModified
 			writeNotModified(w)
 			return true, ""
 		} else {
-			w.WriteHeader(StatusPreconditionFailed)
+			status = StatusPreconditionFailed
+			w.WriteHeader(status)
 			return true, ""
 		}
 	case condNone:
-		if checkIfModifiedSince(r, modtime) == condFalse {
+		if eval("If-Modified-Since", checkIfModifiedSince(r, modtime)) == condFalse {
+			status = StatusNotModified
 			writeNotModified(w)
 			return true, ""
 		}
@@ -533,9 +558,15 @@ func checkPreconditions(w ResponseWriter, r *Request, modtime time.Time) (done b
 
 	rangeHeader = r.Header.get("Range")
 	if rangeHeader != "" {
-		if checkIfRange(w, r, modtime) == condFalse {
+		ch := eval("If-Range", checkIfRange(w, r, modtime))
+		if ch == condFalse {
 			rangeHeader = ""
 		}
+		if ch != condNone {
+			if trace := traceHooks(httptrace.ContextServerTrace(r.Context()), httptrace.ResponseHooks); trace != nil && trace.IfRangeEvaluated != nil {
+				trace.IfRangeEvaluated(ch == condTrue)
+			}
+		}
 	}
 	return false, rangeHeader
 }
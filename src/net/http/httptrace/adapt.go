@@ -0,0 +1,73 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// errHandlerPanic is reported to ClientTrace.WroteRequest by traces
+// returned by NewClientTraceAdapter when a handler panics with a
+// value that is not an error.
+var errHandlerPanic = errors.New("httptrace: handler panicked")
+
+// NewClientTraceAdapter returns a ServerTrace that reports the
+// events of serving a request to the hooks of ct, so that code
+// written to consume client traces can observe a server. The
+// server's view of an exchange mirrors the client's: the request
+// is read rather than written and the response is written rather
+// than read. The hooks of ct are called as follows:
+//
+//	GotRequest        GetConn, with the client's address, then
+//	                  GotFirstResponseByte
+//	WroteHeader       WroteHeaders, when the response header is
+//	                  written
+//	HandlerDone       WroteRequest, when the response is complete;
+//	                  Err is set if the handler panicked
+//	TLSHandshakeError TLSHandshakeDone, with a zero
+//	                  tls.ConnectionState
+//
+// As for a client, GetConn is thus the first hook called for each
+// request. GotFirstResponseByte is called once the request header has
+// been read, rather than when its first byte arrives, which the server
+// reports before the request it belongs to is known.
+//
+// The other hooks of ct, which describe the client's connection
+// pool, DNS lookups and dials, have no server-side equivalent and
+// are never called. Hooks of the returned trace whose counterpart
+// in ct is nil are left nil.
+func NewClientTraceAdapter(ct *ClientTrace) *ServerTrace {
+	t := new(ServerTrace)
+	if ct.GetConn != nil || ct.GotFirstResponseByte != nil {
+		t.GotRequest = func(info RequestInfo) {
+			if ct.GetConn != nil {
+				ct.GetConn(info.RemoteAddr)
+			}
+			if ct.GotFirstResponseByte != nil {
+				ct.GotFirstResponseByte()
+			}
+		}
+	}
+	if ct.WroteHeaders != nil {
+		t.WroteHeader = func(WroteHeaderInfo) { ct.WroteHeaders() }
+	}
+	if ct.WroteRequest != nil {
+		t.HandlerDone = func(info HandlerDoneInfo) {
+			var err error
+			if info.Panic != nil {
+				var ok bool
+				if err, ok = info.Panic.(error); !ok {
+					err = errHandlerPanic
+				}
+			}
+			ct.WroteRequest(WroteRequestInfo{Err: err})
+		}
+	}
+	if ct.TLSHandshakeDone != nil {
+		t.TLSHandshakeError = func(err error) { ct.TLSHandshakeDone(tls.ConnectionState{}, err) }
+	}
+	return t
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestClientTraceAdapter(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(ev string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}
+	done := make(chan error, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	var remoteAddr string
+	ts.Config.Trace = NewClientTraceAdapter(&ClientTrace{
+		GotFirstResponseByte: func() { record("GotFirstResponseByte") },
+		GetConn: func(hostPort string) {
+			mu.Lock()
+			remoteAddr = hostPort
+			mu.Unlock()
+			record("GetConn")
+		},
+		WroteHeaders: func() { record("WroteHeaders") },
+		WroteRequest: func(info WroteRequestInfo) {
+			record("WroteRequest")
+			done <- info.Err
+		},
+	})
+	ts.Start()
+	defer ts.Close()
+
+	var localAddr string
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req = req.WithContext(WithClientTrace(req.Context(), &ClientTrace{
+		GotConn: func(info GotConnInfo) { localAddr = info.Conn.LocalAddr().String() },
+	}))
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("WroteRequest error = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WroteRequest not called")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// GetConn comes first, as it does for a client.
+	want := []string{"GetConn", "GotFirstResponseByte", "WroteHeaders", "WroteRequest"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q; want %q", events, want)
+	}
+	if remoteAddr != localAddr {
+		t.Errorf("GetConn(%q); want client address %q", remoteAddr, localAddr)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"reflect"
+	"sync"
+)
+
+// defaultAsyncBuffer is the number of hook calls queued by an Async
+// trace whose AsyncBuffer is zero.
+const defaultAsyncBuffer = 1024
+
+// A hookQueue runs the hook calls of an Async trace, in order, on a
+// background goroutine. The goroutine is started when calls are
+// queued and exits when the queue is empty.
+type hookQueue struct {
+	calls  chan func()
+	policy FullPolicy
+
+	mu      sync.Mutex
+	running bool // whether the goroutine is running
+}
+
+func newHookQueue(size int, policy FullPolicy) *hookQueue {
+	if size <= 0 {
+		size = defaultAsyncBuffer
+	}
+	return &hookQueue{calls: make(chan func(), size), policy: policy}
+}
+
+// add queues call, or drops it if the queue is full and q's policy is
+// DropWhenFull.
+func (q *hookQueue) add(call func()) {
+	select {
+	case q.calls <- call:
+	default:
+		if q.policy == DropWhenFull {
+			return
+		}
+		// The queue is full, so the goroutine is running, or is
+		// about to be started by a caller that filled it, and
+		// will make room.
+		q.calls <- call
+	}
+	q.mu.Lock()
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	q.mu.Unlock()
+}
+
+func (q *hookQueue) run() {
+	for {
+		select {
+		case call := <-q.calls:
+			call()
+		default:
+			q.mu.Lock()
+			if len(q.calls) == 0 {
+				q.running = false
+				q.mu.Unlock()
+				return
+			}
+			q.mu.Unlock()
+		}
+	}
+}
+
+// copyArgs returns copies of the arguments of a hook call that share
+// no maps or slices with them, so that a queued call does not see
+// them change. Values referred to by pointers and interfaces are not
+// copied.
+func copyArgs(args []reflect.Value) []reflect.Value {
+	c := make([]reflect.Value, len(args))
+	for i, v := range args {
+		c[i] = deepCopy(v)
+	}
+	return c
+}
+
+// deepCopy returns a copy of v that shares no maps or slices with it.
+// Unexported struct fields are copied shallowly.
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		m := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, k := range v.MapKeys() {
+			m.SetMapIndex(k, deepCopy(v.MapIndex(k)))
+		}
+		return m
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		s := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(s, v)
+		if hasRefs(v.Type().Elem()) {
+			for i := 0; i < v.Len(); i++ {
+				s.Index(i).Set(deepCopy(v.Index(i)))
+			}
+		}
+		return s
+	case reflect.Array:
+		a := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			a.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return a
+	case reflect.Struct:
+		s := reflect.New(v.Type()).Elem()
+		s.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if f := s.Field(i); f.CanSet() {
+				f.Set(deepCopy(v.Field(i)))
+			}
+		}
+		return s
+	}
+	return v
+}
+
+// hasRefs reports whether values of type t may contain maps or slices
+// that deepCopy copies.
+func hasRefs(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// TraceConfig holds the configuration of a ServerTrace: the fields
+// that are not hooks. Unlike a ServerTrace, it can be serialized, for
+// example with encoding/json, so that tracing can be configured
+// outside the program. Each field has the meaning of the ServerTrace
+// field of the same name.
+//
+// ContextKeys and Client are not part of a TraceConfig, as they hold
+// values of arbitrary type. Output has no ServerTrace counterpart; it
+// selects the hooks NewTraceFromConfig sets.
+type TraceConfig struct {
+	// Output is where the trace logs requests: "stderr" or
+	// "stdout" for a line when each request is read and another
+	// when its handler is done, or "" for no hooks.
+	Output string `json:"output,omitempty"`
+
+	Name                string                   `json:"name,omitempty"`
+	Enabled             HookCategory             `json:"enabled,omitempty"`
+	Compose             ComposePolicy            `json:"compose,omitempty"`
+	ComposeOrder        map[string]ComposePolicy `json:"composeOrder,omitempty"`
+	StallThreshold      time.Duration            `json:"stallThreshold,omitempty"`
+	WriteBlockThreshold time.Duration            `json:"writeBlockThreshold,omitempty"`
+	HookBudget          time.Duration            `json:"hookBudget,omitempty"`
+	SingleValueHeaders  []string                 `json:"singleValueHeaders,omitempty"`
+	CaptureResponseBody int                      `json:"captureResponseBody,omitempty"`
+	MaxChunkHooks       int                      `json:"maxChunkHooks,omitempty"`
+	CapturePanicStack   bool                     `json:"capturePanicStack,omitempty"`
+	CaptureHeaderOrder  bool                     `json:"captureHeaderOrder,omitempty"`
+	MeasurePeakHeap     bool                     `json:"measurePeakHeap,omitempty"`
+	Async               bool                     `json:"async,omitempty"`
+	AsyncBuffer         int                      `json:"asyncBuffer,omitempty"`
+	AsyncFullPolicy     FullPolicy               `json:"asyncFullPolicy,omitempty"`
+	CountHooks          bool                     `json:"countHooks,omitempty"`
+}
+
+// NewTraceFromConfig returns a ServerTrace configured by cfg. The
+// trace has the hooks that log to cfg.Output, if any; add others
+// with AddHook, or install it with WithServerTrace over a trace whose
+// hooks it should inherit. NewTraceFromConfig returns an error if
+// cfg.Output is not one of the values described by TraceConfig, or if
+// a key of cfg.ComposeOrder is not the name of a hook.
+func NewTraceFromConfig(cfg TraceConfig) (*ServerTrace, error) {
+	if err := checkComposeOrder(cfg.ComposeOrder); err != nil {
+		return nil, err
+	}
+	t := new(ServerTrace)
+	copyConfig(reflect.ValueOf(t).Elem(), reflect.ValueOf(cfg))
+	switch cfg.Output {
+	case "":
+	case "stderr":
+		t.logTo(os.Stderr)
+	case "stdout":
+		t.logTo(os.Stdout)
+	default:
+		return nil, errors.New("httptrace: unknown TraceConfig.Output " + strconv.Quote(cfg.Output))
+	}
+	t.output = cfg.Output
+	return t, nil
+}
+
+// logTo sets the GotRequest and HandlerDone hooks of t to log each
+// request to w.
+func (t *ServerTrace) logTo(w io.Writer) {
+	l := log.New(w, "httptrace: ", log.LstdFlags)
+	t.GotRequest = func(info RequestInfo) {
+		l.Printf("request %d: %s %s %s from %s", info.ID, info.Method, info.RequestURI, info.Proto, info.RemoteAddr)
+	}
+	t.HandlerDone = func(info HandlerDoneInfo) {
+		l.Printf("request %d: status %d, read %d, wrote %d bytes in %v", info.ID, info.StatusCode, info.BytesRead, info.BytesWritten, info.Duration)
+	}
+}
+
+// Config returns the configuration of t. It shares no maps or slices
+// with t.
+func (t *ServerTrace) Config() TraceConfig {
+	var cfg TraceConfig
+	copyConfig(reflect.ValueOf(&cfg).Elem(), reflect.ValueOf(t).Elem())
+	cfg.Output = t.output
+	return cfg
+}
+
+// copyConfig sets each field of TraceConfig but Output in dst, a
+// TraceConfig or ServerTrace, to a deep copy of the field of the same
+// name in src, the other.
+func copyConfig(dst, src reflect.Value) {
+	cfgType := reflect.TypeOf(TraceConfig{})
+	for i := 0; i < cfgType.NumField(); i++ {
+		name := cfgType.Field(i).Name
+		if name == "Output" {
+			continue
+		}
+		dst.FieldByName(name).Set(deepCopy(src.FieldByName(name)))
+	}
+}
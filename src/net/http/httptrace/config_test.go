@@ -0,0 +1,127 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTraceConfigRoundTrip(t *testing.T) {
+	cfg := TraceConfig{
+		Name:               "sidecar",
+		Enabled:            RequestHooks | ErrorHooks,
+		Compose:            OldFirst,
+		ComposeOrder:       map[string]ComposePolicy{"HandlerDone": NewFirst},
+		StallThreshold:     2 * time.Second,
+		SingleValueHeaders: []string{"Content-Type"},
+		MaxChunkHooks:      10,
+		CapturePanicStack:  true,
+		AsyncFullPolicy:    DropWhenFull,
+		Output:             "stderr",
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TraceConfig
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	trace, err := NewTraceFromConfig(decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := trace.Config(); !reflect.DeepEqual(got, cfg) {
+		t.Errorf("config after round trip = %+v; want %+v", got, cfg)
+	}
+	if trace.Name != "sidecar" || trace.StallThreshold != 2*time.Second || trace.MaxChunkHooks != 10 {
+		t.Errorf("trace = %+v; not configured per %s", trace, b)
+	}
+	if !trace.IsEnabled(RequestHooks) || trace.IsEnabled(ResponseHooks) {
+		t.Errorf("trace Enabled = %v; want %v", trace.Enabled, cfg.Enabled)
+	}
+}
+
+func TestTraceConfigCompose(t *testing.T) {
+	var calls []string
+	old := &ServerTrace{
+		GotMethod: func(string) { calls = append(calls, "old") },
+	}
+	trace, err := NewTraceFromConfig(TraceConfig{Compose: OldFirst})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trace.AddHook("GotMethod", func(string) { calls = append(calls, "new") })
+	ctx := WithServerTrace(context.Background(), old)
+	ctx = WithServerTrace(ctx, trace)
+	ContextServerTrace(ctx).GotMethod("GET")
+	if want := []string{"old", "new"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q; want %q", calls, want)
+	}
+
+	cfg := TraceConfig{ComposeOrder: map[string]ComposePolicy{"WroteHeaders": OldFirst}}
+	if trace, err := NewTraceFromConfig(cfg); err == nil {
+		t.Errorf("NewTraceFromConfig with unknown ComposeOrder hook = %v, nil; want error", trace)
+	}
+}
+
+func TestTraceConfigOutput(t *testing.T) {
+	if trace, err := NewTraceFromConfig(TraceConfig{}); err != nil || trace.GotRequest != nil || trace.HandlerDone != nil {
+		t.Errorf("trace without Output has hooks, or error %v", err)
+	}
+	trace, err := NewTraceFromConfig(TraceConfig{Output: "stdout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.GotRequest == nil || trace.HandlerDone == nil {
+		t.Fatalf("trace with Output %q has no GotRequest or HandlerDone hook", "stdout")
+	}
+
+	var buf bytes.Buffer
+	trace.logTo(&buf)
+	trace.GotRequest(RequestInfo{ID: 7, Method: "GET", RequestURI: "/x", Proto: "HTTP/1.1", RemoteAddr: "192.0.2.1:1234"})
+	trace.HandlerDone(HandlerDoneInfo{ID: 7, StatusCode: 404, BytesWritten: 9, Duration: time.Millisecond})
+	for _, want := range []string{
+		"request 7: GET /x HTTP/1.1 from 192.0.2.1:1234\n",
+		"request 7: status 404, read 0, wrote 9 bytes in 1ms\n",
+	} {
+		if !bytes.Contains(buf.Bytes(), []byte(want)) {
+			t.Errorf("log = %q; want it to contain %q", buf.String(), want)
+		}
+	}
+
+	if trace, err := NewTraceFromConfig(TraceConfig{Output: "syslog"}); err == nil {
+		t.Errorf("NewTraceFromConfig with unknown Output = %v, nil; want error", trace)
+	}
+}
+
+func TestTraceConfigCopies(t *testing.T) {
+	cfg := TraceConfig{
+		ComposeOrder:       map[string]ComposePolicy{"HandlerDone": NewFirst},
+		SingleValueHeaders: []string{"Content-Type"},
+	}
+	trace, err := NewTraceFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ComposeOrder["HandlerDone"] = OldFirst
+	cfg.SingleValueHeaders[0] = "Host"
+
+	got := trace.Config()
+	got.ComposeOrder["GotRequest"] = OldFirst
+	got.SingleValueHeaders[0] = "Host"
+
+	if want := map[string]ComposePolicy{"HandlerDone": NewFirst}; !reflect.DeepEqual(trace.ComposeOrder, want) {
+		t.Errorf("trace ComposeOrder = %v; want %v", trace.ComposeOrder, want)
+	}
+	if want := []string{"Content-Type"}; !reflect.DeepEqual(trace.SingleValueHeaders, want) {
+		t.Errorf("trace SingleValueHeaders = %q; want %q", trace.SingleValueHeaders, want)
+	}
+}
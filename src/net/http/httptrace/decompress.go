@@ -0,0 +1,87 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+// NewDecompressingBody returns a ReadCloser that reads the
+// decompressed contents of body, a request body with the given
+// Content-Encoding, which must be "gzip" or "x-gzip". Handlers that
+// transparently decompress request bodies may replace the request's
+// Body with it. When the returned body has been read to its end or is
+// closed, it calls the DecompressedRequest hook of trace, if any,
+// with the number of compressed bytes read from body and the number
+// of decompressed bytes returned.
+//
+// It returns an error if encoding is not supported or the gzip
+// header of body is invalid.
+func NewDecompressingBody(body io.ReadCloser, encoding string, trace *ServerTrace) (io.ReadCloser, error) {
+	if encoding != "gzip" && encoding != "x-gzip" {
+		return nil, errors.New("httptrace: unsupported content encoding " + encoding)
+	}
+	db := &decompressingBody{
+		body:       body,
+		encoding:   encoding,
+		trace:      trace,
+		compressed: countingReader{r: body},
+	}
+	zr, err := gzip.NewReader(&db.compressed)
+	if err != nil {
+		return nil, err
+	}
+	db.zr = zr
+	return db, nil
+}
+
+type decompressingBody struct {
+	body       io.ReadCloser
+	encoding   string
+	trace      *ServerTrace
+	compressed countingReader
+	zr         *gzip.Reader
+	n          int64 // decompressed bytes read
+	once       sync.Once
+}
+
+func (b *decompressingBody) Read(p []byte) (int, error) {
+	n, err := b.zr.Read(p)
+	b.n += int64(n)
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *decompressingBody) Close() error {
+	b.done()
+	return b.body.Close()
+}
+
+// done calls the DecompressedRequest hook the first time it is
+// called.
+func (b *decompressingBody) done() {
+	b.once.Do(func() {
+		if b.trace != nil && b.trace.DecompressedRequest != nil && b.trace.IsEnabled(BodyHooks) {
+			b.trace.DecompressedRequest(b.encoding, b.compressed.n, b.n)
+		}
+	})
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
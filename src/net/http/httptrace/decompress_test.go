@@ -0,0 +1,70 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"strings"
+	"testing"
+)
+
+func TestDecompressingBody(t *testing.T) {
+	body := strings.Repeat("hello, world\n", 1000)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	type result struct {
+		encoding                 string
+		compressed, decompressed int64
+	}
+	results := make(chan result, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := NewDecompressingBody(r.Body, r.Header.Get("Content-Encoding"), ContextServerTrace(r.Context()))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		got, err := ioutil.ReadAll(b)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(got) != body {
+			t.Errorf("decompressed body = %d bytes; want %d", len(got), len(body))
+		}
+	}))
+	ts.Config.Trace = &ServerTrace{
+		DecompressedRequest: func(encoding string, compressed, decompressed int64) {
+			results <- result{encoding, compressed, decompressed}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	req, _ := http.NewRequest("POST", ts.URL, bytes.NewReader(compressed.Bytes()))
+	req.Header.Set("Content-Encoding", "gzip")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	want := result{"gzip", int64(compressed.Len()), int64(len(body))}
+	if got := <-results; got != want {
+		t.Errorf("DecompressedRequest = %+v; want %+v", got, want)
+	}
+}
+
+func TestDecompressingBodyUnsupported(t *testing.T) {
+	if _, err := NewDecompressingBody(ioutil.NopCloser(strings.NewReader("")), "br", nil); err == nil {
+		t.Error("NewDecompressingBody with encoding br succeeded; want error")
+	}
+}
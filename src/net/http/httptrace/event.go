@@ -0,0 +1,151 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"reflect"
+	"time"
+)
+
+// An EventName names a ServerTrace hook. Its value is the name of the
+// corresponding ServerTrace field.
+type EventName string
+
+const (
+	EventServeStart                  EventName = "ServeStart"
+	EventServeShutdown               EventName = "ServeShutdown"
+	EventTLSHandshakeError           EventName = "TLSHandshakeError"
+	EventProtocolNegotiated          EventName = "ProtocolNegotiated"
+	EventSocketOptions               EventName = "SocketOptions"
+	EventReadFirstByte               EventName = "ReadFirstByte"
+	EventGotMethod                   EventName = "GotMethod"
+	EventGotRequest                  EventName = "GotRequest"
+	EventEffectiveDeadline           EventName = "EffectiveDeadline"
+	EventGotQuery                    EventName = "GotQuery"
+	EventGotCookie                   EventName = "GotCookie"
+	EventGotTraceContext             EventName = "GotTraceContext"
+	EventTargetNormalized            EventName = "TargetNormalized"
+	EventGotAbsoluteURI              EventName = "GotAbsoluteURI"
+	EventGotAuthScheme               EventName = "GotAuthScheme"
+	EventGotServerOptions            EventName = "GotServerOptions"
+	EventGotContextKeys              EventName = "GotContextKeys"
+	EventPathCleaned                 EventName = "PathCleaned"
+	EventBodyReadStall               EventName = "BodyReadStall"
+	EventBodyReadComplete            EventName = "BodyReadComplete"
+	EventGotRequestTrailers          EventName = "GotRequestTrailers"
+	EventBodyLimitExceeded           EventName = "BodyLimitExceeded"
+	EventDecompressedRequest         EventName = "DecompressedRequest"
+	EventGotRequestBodyType          EventName = "GotRequestBodyType"
+	EventWroteHeader                 EventName = "WroteHeader"
+	EventCacheHeaders                EventName = "CacheHeaders"
+	EventRedirected                  EventName = "Redirected"
+	EventProxyBackendDone            EventName = "ProxyBackendDone"
+	EventConditionalResult           EventName = "ConditionalResult"
+	EventIfRangeEvaluated            EventName = "IfRangeEvaluated"
+	EventMethodNotAllowed            EventName = "MethodNotAllowed"
+	EventDuplicateHeader             EventName = "DuplicateHeader"
+	EventSniffedContentType          EventName = "SniffedContentType"
+	EventWroteServerHeader           EventName = "WroteServerHeader"
+	EventWroteDate                   EventName = "WroteDate"
+	EventAutoChunked                 EventName = "AutoChunked"
+	EventHeaderSanitized             EventName = "HeaderSanitized"
+	EventNoContentLength             EventName = "NoContentLength"
+	EventNegotiatedEncoding          EventName = "NegotiatedEncoding"
+	EventWroteBodyChunk              EventName = "WroteBodyChunk"
+	EventWroteFinalChunk             EventName = "WroteFinalChunk"
+	EventResponseTruncated           EventName = "ResponseTruncated"
+	EventHeadBodyDiscarded           EventName = "HeadBodyDiscarded"
+	EventGotResponsePrefix           EventName = "GotResponsePrefix"
+	EventFrameRead                   EventName = "FrameRead"
+	EventFrameWrite                  EventName = "FrameWrite"
+	EventZeroCopyUsed                EventName = "ZeroCopyUsed"
+	EventWriteBlocked                EventName = "WriteBlocked"
+	EventBufioPoolEvent              EventName = "BufioPoolEvent"
+	EventConnectionReset             EventName = "ConnectionReset"
+	EventConnectionLimited           EventName = "ConnectionLimited"
+	EventRequestsPerConnLimitReached EventName = "RequestsPerConnLimitReached"
+	EventSmugglingRejected           EventName = "SmugglingRejected"
+	EventMethodRejected              EventName = "MethodRejected"
+	EventStatusChangeAttempt         EventName = "StatusChangeAttempt"
+	EventHandlerTimeout              EventName = "HandlerTimeout"
+	EventPanicAfterCommit            EventName = "PanicAfterCommit"
+	EventHijackFailed                EventName = "HijackFailed"
+	EventHandlerDone                 EventName = "HandlerDone"
+	EventConnSummary                 EventName = "ConnSummary"
+)
+
+// An Event is a single call of a ServerTrace hook.
+type Event struct {
+	// Name is the hook that was called.
+	Name EventName
+
+	// Time is when the hook was called.
+	Time time.Time
+
+	// Info is the argument of the hook, such as a RequestInfo for
+	// EventGotRequest, or nil for hooks without an argument. For
+	// hooks with several arguments, such as MethodRejected, it is
+	// a []interface{} holding the arguments in order.
+	Info interface{}
+}
+
+// A FullPolicy determines what a channel trace does with an event
+// when its channel is full.
+type FullPolicy int
+
+const (
+	// BlockWhenFull waits until the event can be sent. The
+	// server is stalled while it waits.
+	BlockWhenFull FullPolicy = iota
+
+	// DropWhenFull discards the event.
+	DropWhenFull
+)
+
+// NewChannelTrace returns a ServerTrace with every hook set, each of
+// which sends an Event describing its call on ch. If ch is full, the
+// event is sent or dropped according to policy. The maps and slices
+// in the hook arguments, such as WroteHeaderInfo.Header, are copied
+// before the event is sent, so the receiver may retain them. As with
+// RecordingTrace, hooks that also require a threshold are not called
+// until the threshold is set on the returned trace.
+func NewChannelTrace(ch chan<- Event, policy FullPolicy) *ServerTrace {
+	t := new(ServerTrace)
+	tv := reflect.ValueOf(t).Elem()
+	structType := tv.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		f := tv.Field(i)
+		hookType := f.Type()
+		if !isHook(structType.Field(i)) {
+			continue
+		}
+		name := EventName(structType.Field(i).Name)
+		f.Set(reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+			ev := Event{Name: name, Time: time.Now()}
+			args = copyArgs(args)
+			switch len(args) {
+			case 0:
+			case 1:
+				ev.Info = args[0].Interface()
+			default:
+				info := make([]interface{}, len(args))
+				for i, arg := range args {
+					info[i] = arg.Interface()
+				}
+				ev.Info = info
+			}
+			if policy == DropWhenFull {
+				select {
+				case ch <- ev:
+				default:
+				}
+			} else {
+				ch <- ev
+			}
+			return zeroResults(hookType)
+		}))
+	}
+	return t
+}
@@ -0,0 +1,166 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChannelTrace(t *testing.T) {
+	ch := make(chan Event, 100)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "hello")
+	}))
+	ts.Config.Trace = NewChannelTrace(ch, BlockWhenFull)
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	var got []EventName
+	for {
+		var ev Event
+		select {
+		case ev = <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for HandlerDone; events = %v", got)
+		}
+		switch ev.Name {
+		case EventGotRequest, EventWroteHeader, EventWroteBodyChunk, EventHandlerDone:
+			got = append(got, ev.Name)
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("%s: zero Time", ev.Name)
+		}
+		if ev.Name == EventWroteHeader {
+			if info, ok := ev.Info.(WroteHeaderInfo); !ok || info.StatusCode != http.StatusAccepted {
+				t.Errorf("WroteHeader Info = %#v; want WroteHeaderInfo with status %d", ev.Info, http.StatusAccepted)
+			}
+		}
+		if ev.Name == EventHandlerDone {
+			break
+		}
+	}
+	want := []EventName{EventGotRequest, EventWroteHeader, EventWroteBodyChunk, EventHandlerDone}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v; want %v", got, want)
+	}
+}
+
+func TestChannelTraceDropWhenFull(t *testing.T) {
+	ch := make(chan Event, 1)
+	trace := NewChannelTrace(ch, DropWhenFull)
+	trace.GotRequest(RequestInfo{ID: 1})
+	trace.ConnectionReset()
+	ev := <-ch
+	if ev.Name != EventGotRequest {
+		t.Errorf("Name = %q; want %q", ev.Name, EventGotRequest)
+	}
+	if info, ok := ev.Info.(RequestInfo); !ok || info.ID != 1 {
+		t.Errorf("Info = %#v; want RequestInfo with ID 1", ev.Info)
+	}
+	select {
+	case ev := <-ch:
+		t.Errorf("got dropped event %q", ev.Name)
+	default:
+	}
+
+	trace.MethodRejected("G@T", 400)
+	ev = <-ch
+	if want := []interface{}{"G@T", 400}; !reflect.DeepEqual(ev.Info, want) {
+		t.Errorf("MethodRejected Info = %#v; want %#v", ev.Info, want)
+	}
+}
+
+func TestEventNames(t *testing.T) {
+	// Every hook has an EventName constant of the same name.
+	names := map[EventName]bool{
+		EventServeStart:                  true,
+		EventServeShutdown:               true,
+		EventTLSHandshakeError:           true,
+		EventProtocolNegotiated:          true,
+		EventSocketOptions:               true,
+		EventReadFirstByte:               true,
+		EventGotMethod:                   true,
+		EventGotRequest:                  true,
+		EventEffectiveDeadline:           true,
+		EventGotQuery:                    true,
+		EventGotCookie:                   true,
+		EventGotTraceContext:             true,
+		EventTargetNormalized:            true,
+		EventGotAbsoluteURI:              true,
+		EventGotAuthScheme:               true,
+		EventGotServerOptions:            true,
+		EventGotContextKeys:              true,
+		EventPathCleaned:                 true,
+		EventBodyReadStall:               true,
+		EventBodyReadComplete:            true,
+		EventGotRequestTrailers:          true,
+		EventBodyLimitExceeded:           true,
+		EventDecompressedRequest:         true,
+		EventGotRequestBodyType:          true,
+		EventWroteHeader:                 true,
+		EventCacheHeaders:                true,
+		EventRedirected:                  true,
+		EventProxyBackendDone:            true,
+		EventConditionalResult:           true,
+		EventIfRangeEvaluated:            true,
+		EventMethodNotAllowed:            true,
+		EventDuplicateHeader:             true,
+		EventSniffedContentType:          true,
+		EventWroteServerHeader:           true,
+		EventWroteDate:                   true,
+		EventAutoChunked:                 true,
+		EventHeaderSanitized:             true,
+		EventNoContentLength:             true,
+		EventNegotiatedEncoding:          true,
+		EventWroteBodyChunk:              true,
+		EventWroteFinalChunk:             true,
+		EventResponseTruncated:           true,
+		EventHeadBodyDiscarded:           true,
+		EventGotResponsePrefix:           true,
+		EventFrameRead:                   true,
+		EventFrameWrite:                  true,
+		EventZeroCopyUsed:                true,
+		EventWriteBlocked:                true,
+		EventBufioPoolEvent:              true,
+		EventConnectionReset:             true,
+		EventConnectionLimited:           true,
+		EventRequestsPerConnLimitReached: true,
+		EventSmugglingRejected:           true,
+		EventMethodRejected:              true,
+		EventStatusChangeAttempt:         true,
+		EventHandlerTimeout:              true,
+		EventPanicAfterCommit:            true,
+		EventHijackFailed:                true,
+		EventHandlerDone:                 true,
+		EventConnSummary:                 true,
+	}
+	typ := reflect.TypeOf(ServerTrace{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.Type.Kind() != reflect.Func || f.Name == "OnHookPanic" || f.Name == "ComposeTrace" || f.Name == "SlowHook" {
+			continue
+		}
+		if !names[EventName(f.Name)] {
+			t.Errorf("no EventName constant for ServerTrace.%s", f.Name)
+		}
+		delete(names, EventName(f.Name))
+	}
+	for name := range names {
+		t.Errorf("EventName %q has no ServerTrace hook", name)
+	}
+}
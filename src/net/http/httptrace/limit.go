@@ -0,0 +1,111 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+var (
+	errLimitListenerClosed = errors.New("httptrace: use of closed limit listener")
+	errNotSupported        = errors.New("httptrace: operation not supported by the underlying connection")
+)
+
+// NewLimitListener returns a Listener that accepts at most n
+// simultaneous connections from l. A connection accepted while n
+// connections are open is held, without being returned by Accept,
+// until one of them is closed. The ConnectionLimited hook of trace,
+// if any, is called each time a connection is held.
+func NewLimitListener(l net.Listener, n int, trace *ServerTrace) net.Listener {
+	return &limitListener{
+		Listener: l,
+		sem:      make(chan struct{}, n),
+		done:     make(chan struct{}),
+		trace:    trace,
+	}
+}
+
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	trace     *ServerTrace
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case l.sem <- struct{}{}:
+	default:
+		if t := l.trace; t != nil && t.ConnectionLimited != nil && t.IsEnabled(ConnectionHooks) {
+			t.ConnectionLimited()
+		}
+		select {
+		case l.sem <- struct{}{}:
+		case <-l.done:
+			c.Close()
+			return nil, errLimitListenerClosed
+		}
+	}
+	return &limitListenerConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+// ReadFrom implements io.ReaderFrom, so that servers can still copy
+// files to connections whose own ReadFrom uses sendfile.
+func (c *limitListenerConn) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := c.Conn.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(c.Conn, r)
+}
+
+// CloseWrite shuts down the writing side of the underlying
+// connection, so that servers can still signal the end of their
+// responses to clients before closing TCP connections.
+func (c *limitListenerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return errNotSupported
+}
+
+// SyscallConn returns the raw network connection of the underlying
+// connection, if it has one.
+func (c *limitListenerConn) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := c.Conn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	}); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errNotSupported
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
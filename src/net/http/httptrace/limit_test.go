@@ -0,0 +1,176 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestLimitListener(t *testing.T) {
+	started := make(chan bool, 2)
+	release := make(chan bool)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+	}))
+	limited := make(chan bool, 1)
+	ts.Listener = NewLimitListener(ts.Listener, 1, &ServerTrace{
+		ConnectionLimited: func() { limited <- true },
+	})
+	ts.Start()
+	defer ts.Close()
+
+	const req = "GET / HTTP/1.1\r\nHost: foo\r\nConnection: close\r\n\r\n"
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		io.WriteString(c, req)
+		conns = append(conns, c)
+	}
+
+	<-started
+	select {
+	case <-limited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectionLimited not called")
+	}
+	select {
+	case <-started:
+		t.Fatal("second connection served while the first is open")
+	default:
+	}
+
+	close(release)
+	for i, c := range conns {
+		res, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("conn %d: %v", i, err)
+		}
+		res.Body.Close()
+	}
+}
+
+func TestLimitListenerZeroCopy(t *testing.T) {
+	f, err := ioutil.TempFile("", "limit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	io.WriteString(f, "hello, world")
+	f.Close()
+
+	got := make(chan bool, 1)
+	trace := &ServerTrace{
+		ZeroCopyUsed: func(used bool) { got <- used },
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, f.Name())
+	}))
+	ts.Config.Trace = trace
+	ts.Listener = NewLimitListener(ts.Listener, 1, trace)
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil || string(body) != "hello, world" {
+		t.Fatalf("body = %q, %v; want %q", body, err, "hello, world")
+	}
+	// The server copies files to TCP connections in the kernel on
+	// these systems.
+	var want bool
+	switch runtime.GOOS {
+	case "dragonfly", "freebsd", "linux", "solaris", "windows":
+		want = true
+	}
+	select {
+	case used := <-got:
+		if used != want {
+			t.Errorf("ZeroCopyUsed(%v) behind a limit listener; want %v", used, want)
+		}
+	default:
+		t.Error("ZeroCopyUsed not called")
+	}
+}
+
+func TestLimitListenerCloseWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln = NewLimitListener(ln, 1, nil)
+	defer ln.Close()
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	sc, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	cw, ok := sc.(interface {
+		CloseWrite() error
+	})
+	if !ok {
+		t.Fatalf("%T has no CloseWrite method", sc)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %v", err)
+	}
+	cc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := cc.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("client Read after CloseWrite = %d, %v; want 0, EOF", n, err)
+	}
+}
+
+func TestLimitListenerSocketOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("SocketOptions is not supported on %s", runtime.GOOS)
+	}
+	got := make(chan SocketOptionsInfo, 1)
+	trace := &ServerTrace{
+		SocketOptions: func(info SocketOptionsInfo) { got <- info },
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.Config.Trace = trace
+	ts.Listener = NewLimitListener(ts.Listener, 1, trace)
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case info := <-got:
+		if !info.NoDelay {
+			t.Errorf("SocketOptions NoDelay = false; want true")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SocketOptions not called behind a limit listener")
+	}
+}
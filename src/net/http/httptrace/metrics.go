@@ -0,0 +1,115 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A Counter is a count that is safe for concurrent use, such as from
+// ServerTrace hooks called for concurrent requests. The zero value is
+// a Counter with value zero. A Counter must not be copied after first
+// use.
+type Counter struct {
+	n int64
+}
+
+// Add adds delta to c.
+func (c *Counter) Add(delta int64) {
+	atomic.AddInt64(&c.n, delta)
+}
+
+// Value returns the current value of c.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// A Histogram counts observed values in buckets. It is safe for
+// concurrent use. A Histogram must not be copied after first use.
+type Histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []int64 // len(bounds)+1; the last bucket counts values above all bounds
+	count  int64
+	sum    float64
+}
+
+// NewHistogram returns a Histogram with a bucket for each of the
+// given upper bounds, which must be in increasing order, and a final
+// bucket for values greater than all of them.
+func NewHistogram(bounds ...float64) *Histogram {
+	if !sort.Float64sAreSorted(bounds) {
+		panic("httptrace: histogram bounds not in increasing order")
+	}
+	return &Histogram{
+		bounds: append([]float64(nil), bounds...),
+		counts: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe adds v to the bucket with the smallest upper bound that is
+// greater than or equal to v.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+// A HistogramSnapshot is the state of a Histogram at one point in
+// time.
+type HistogramSnapshot struct {
+	// Bounds are the upper bounds of the buckets.
+	Bounds []float64
+
+	// Counts are the number of values observed in each bucket.
+	// It has one more element than Bounds, counting the values
+	// greater than all bounds.
+	Counts []int64
+
+	// Count and Sum are the number and sum of all observed values.
+	Count int64
+	Sum   float64
+}
+
+// Snapshot returns the current state of h.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return HistogramSnapshot{
+		Bounds: append([]float64(nil), h.bounds...),
+		Counts: append([]int64(nil), h.counts...),
+		Count:  h.count,
+		Sum:    h.sum,
+	}
+}
+
+// Quantile returns the upper bound of the bucket containing the q-th
+// quantile of the observed values, for q between 0 and 1. If that is
+// the final bucket, which has no upper bound, Quantile returns the
+// largest bound. If no values have been observed, it returns zero.
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 || len(s.Bounds) == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(s.Count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var cum int64
+	for i, n := range s.Counts[:len(s.Bounds)] {
+		cum += n
+		if cum >= rank {
+			return s.Bounds[i]
+		}
+	}
+	return s.Bounds[len(s.Bounds)-1]
+}
@@ -0,0 +1,68 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	const goroutines, adds = 50, 1000
+	var c Counter
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				c.Add(1)
+				c.Value()
+			}
+		}()
+	}
+	wg.Wait()
+	if got, want := c.Value(), int64(goroutines*adds); got != want {
+		t.Errorf("Value() = %d; want %d", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	const goroutines = 50
+	h := NewHistogram(1, 10, 100)
+	values := []float64{0.5, 1, 5, 50, 500}
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, v := range values {
+				h.Observe(v)
+				h.Snapshot()
+			}
+		}()
+	}
+	wg.Wait()
+	got := h.Snapshot()
+	want := HistogramSnapshot{
+		Bounds: []float64{1, 10, 100},
+		Counts: []int64{2 * goroutines, goroutines, goroutines, goroutines},
+		Count:  int64(len(values) * goroutines),
+		Sum:    556.5 * goroutines,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot() = %+v; want %+v", got, want)
+	}
+}
+
+func TestHistogramUnsortedBounds(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewHistogram with unsorted bounds did not panic")
+		}
+	}()
+	NewHistogram(10, 1)
+}
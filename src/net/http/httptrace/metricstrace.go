@@ -0,0 +1,129 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// latencyBounds are the upper bounds, in seconds, of the buckets of
+// Metrics.Latency.
+var latencyBounds = []float64{
+	0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5,
+	1, 2.5, 5, 10, 25, 50, 100,
+}
+
+// Metrics holds aggregate statistics about the requests served with a
+// trace created by NewMetricsTrace. It is safe for concurrent use.
+type Metrics struct {
+	// Requests is the number of requests whose handlers are done.
+	Requests Counter
+
+	// ErrorResponses is the number of responses with a 4xx or
+	// 5xx status code.
+	ErrorResponses Counter
+
+	// BytesRead and BytesWritten are the total number of request
+	// and response body bytes.
+	BytesRead    Counter
+	BytesWritten Counter
+
+	// Latency is the distribution of request durations, as
+	// reported in HandlerDoneInfo.Duration, in seconds. Its
+	// buckets are fixed, so its memory use does not grow with the
+	// number of requests.
+	Latency *Histogram
+}
+
+// NewMetricsTrace returns a ServerTrace that records the requests it
+// traces in the returned Metrics.
+func NewMetricsTrace() (*ServerTrace, *Metrics) {
+	m := &Metrics{
+		Latency: NewHistogram(latencyBounds...),
+	}
+	trace := &ServerTrace{
+		HandlerDone: m.handlerDone,
+	}
+	return trace, m
+}
+
+func (m *Metrics) handlerDone(info HandlerDoneInfo) {
+	m.Requests.Add(1)
+	if info.StatusCode >= 400 {
+		m.ErrorResponses.Add(1)
+	}
+	m.BytesRead.Add(info.BytesRead)
+	m.BytesWritten.Add(info.BytesWritten)
+	m.Latency.Observe(info.Duration.Seconds())
+}
+
+// LatencyPercentiles returns the 50th, 90th and 99th percentiles of the
+// request durations recorded in m.Latency. Each is the upper bound of
+// the histogram bucket the percentile falls in, so it overestimates
+// the true percentile by at most the width of that bucket. Durations
+// beyond the largest bucket are reported as the largest bucket's
+// bound.
+func (m *Metrics) LatencyPercentiles() (p50, p90, p99 time.Duration) {
+	s := m.Latency.Snapshot()
+	seconds := func(q float64) time.Duration {
+		return time.Duration(s.Quantile(q) * float64(time.Second))
+	}
+	return seconds(0.50), seconds(0.90), seconds(0.99)
+}
+
+// WritePrometheus writes the metrics in m to w in the Prometheus text
+// exposition format, for serving from a /metrics endpoint.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	var b []byte
+	counter := func(name, help string, c *Counter) {
+		b = append(b, "# HELP "+name+" "+help+"\n"...)
+		b = append(b, "# TYPE "+name+" counter\n"...)
+		b = append(b, name+" "...)
+		b = strconv.AppendInt(b, c.Value(), 10)
+		b = append(b, '\n')
+	}
+	counter("http_server_requests_total", "Number of HTTP requests served.", &m.Requests)
+	counter("http_server_error_responses_total", "Number of HTTP responses with a 4xx or 5xx status code.", &m.ErrorResponses)
+	counter("http_server_request_body_bytes_total", "Number of HTTP request body bytes read.", &m.BytesRead)
+	counter("http_server_response_body_bytes_total", "Number of HTTP response body bytes written.", &m.BytesWritten)
+
+	const name = "http_server_request_duration_seconds"
+	s := m.Latency.Snapshot()
+	b = append(b, "# HELP "+name+" Duration of HTTP requests.\n"...)
+	b = append(b, "# TYPE "+name+" histogram\n"...)
+	var cum int64
+	for i, n := range s.Counts {
+		cum += n
+		le := math.Inf(1)
+		if i < len(s.Bounds) {
+			le = s.Bounds[i]
+		}
+		b = append(b, name+`_bucket{le="`...)
+		b = appendFloat(b, le)
+		b = append(b, `"} `...)
+		b = strconv.AppendInt(b, cum, 10)
+		b = append(b, '\n')
+	}
+	b = append(b, name+"_sum "...)
+	b = appendFloat(b, s.Sum)
+	b = append(b, '\n')
+	b = append(b, name+"_count "...)
+	b = strconv.AppendInt(b, s.Count, 10)
+	b = append(b, '\n')
+	_, err := w.Write(b)
+	return err
+}
+
+// appendFloat appends f to b as formatted in the Prometheus text
+// format.
+func appendFloat(b []byte, f float64) []byte {
+	if math.IsInf(f, 1) {
+		return append(b, "+Inf"...)
+	}
+	return strconv.AppendFloat(b, f, 'g', -1, 64)
+}
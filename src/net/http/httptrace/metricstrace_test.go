@@ -0,0 +1,149 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsTrace(t *testing.T) {
+	trace, m := NewMetricsTrace()
+	durations := []struct {
+		d      time.Duration
+		status int
+		n      int
+	}{
+		{800 * time.Microsecond, 200, 50},
+		{20 * time.Millisecond, 200, 40},
+		{200 * time.Millisecond, 404, 9},
+		{3 * time.Second, 500, 1},
+	}
+	for _, d := range durations {
+		for i := 0; i < d.n; i++ {
+			trace.HandlerDone(HandlerDoneInfo{
+				StatusCode:   d.status,
+				BytesRead:    1,
+				BytesWritten: 2,
+				Duration:     d.d,
+			})
+		}
+	}
+	if got := m.Requests.Value(); got != 100 {
+		t.Errorf("Requests = %d; want 100", got)
+	}
+	if got := m.ErrorResponses.Value(); got != 10 {
+		t.Errorf("ErrorResponses = %d; want 10", got)
+	}
+	if got := m.BytesRead.Value(); got != 100 {
+		t.Errorf("BytesRead = %d; want 100", got)
+	}
+	if got := m.BytesWritten.Value(); got != 200 {
+		t.Errorf("BytesWritten = %d; want 200", got)
+	}
+	p50, p90, p99 := m.LatencyPercentiles()
+	if want := time.Millisecond; p50 != want {
+		t.Errorf("p50 = %v; want %v", p50, want)
+	}
+	if want := 25 * time.Millisecond; p90 != want {
+		t.Errorf("p90 = %v; want %v", p90, want)
+	}
+	if want := 250 * time.Millisecond; p99 != want {
+		t.Errorf("p99 = %v; want %v", p99, want)
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	h := NewHistogram(1, 10)
+	if got := h.Snapshot().Quantile(0.5); got != 0 {
+		t.Errorf("empty Quantile(0.5) = %v; want 0", got)
+	}
+	for _, v := range []float64{0.5, 5, 50, 50} {
+		h.Observe(v)
+	}
+	s := h.Snapshot()
+	for _, tt := range []struct {
+		q, want float64
+	}{
+		{0, 1},
+		{0.25, 1},
+		{0.5, 10},
+		{1, 10},
+	} {
+		if got := s.Quantile(tt.q); got != tt.want {
+			t.Errorf("Quantile(%v) = %v; want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsWritePrometheus(t *testing.T) {
+	trace, m := NewMetricsTrace()
+	trace.HandlerDone(HandlerDoneInfo{StatusCode: 200, BytesRead: 3, BytesWritten: 5, Duration: 2 * time.Millisecond})
+	trace.HandlerDone(HandlerDoneInfo{StatusCode: 500, Duration: 200 * time.Second})
+
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Check that every line is a comment or a sample, and that each
+	// metric family has HELP and TYPE lines before its samples.
+	samples := map[string]string{}
+	types := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			f := strings.Fields(line)
+			if len(f) != 4 {
+				t.Fatalf("malformed TYPE line %q", line)
+			}
+			types[f[2]] = f[3]
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			t.Fatalf("malformed sample line %q", line)
+		}
+		name, value := line[:i], line[i+1:]
+		family := name
+		if j := strings.IndexByte(family, '{'); j >= 0 {
+			family = family[:j]
+		}
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if f := strings.TrimSuffix(family, suffix); types[f] == "histogram" {
+				family = f
+			}
+		}
+		if types[family] == "" {
+			t.Errorf("sample %q has no TYPE line before it", line)
+		}
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			t.Errorf("sample %q: %v", line, err)
+		}
+		samples[name] = value
+	}
+
+	for name, want := range map[string]string{
+		"http_server_requests_total":                               "2",
+		"http_server_error_responses_total":                        "1",
+		"http_server_request_body_bytes_total":                     "3",
+		"http_server_response_body_bytes_total":                    "5",
+		`http_server_request_duration_seconds_bucket{le="0.001"}`:  "0",
+		`http_server_request_duration_seconds_bucket{le="0.0025"}`: "1",
+		`http_server_request_duration_seconds_bucket{le="100"}`:    "1",
+		`http_server_request_duration_seconds_bucket{le="+Inf"}`:   "2",
+		"http_server_request_duration_seconds_sum":                 "200.002",
+		"http_server_request_duration_seconds_count":               "2",
+	} {
+		if got := samples[name]; got != want {
+			t.Errorf("%s = %q; want %q", name, got, want)
+		}
+	}
+}
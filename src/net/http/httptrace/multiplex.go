@@ -0,0 +1,151 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"reflect"
+	"time"
+)
+
+// Multiplex returns a ServerTrace that calls the hooks of each of the
+// given traces, in order. Unlike composing traces with
+// WithServerTrace, each trace's hook is called in isolation: a panic
+// in one trace's hook does not prevent the other traces' hooks from
+// being called. It is recovered and reported to that trace's
+// OnHookPanic, if set, or otherwise resumed once the other hooks have
+// been called.
+//
+// The returned trace's StallThreshold and WriteBlockThreshold are the
+// smallest non-zero thresholds of the traces, its CaptureResponseBody
+// is the largest of the traces', its MaxChunkHooks is the largest of
+// the traces' or zero if any of them is zero, its SingleValueHeaders
+// and ContextKeys are the first non-nil ones of the traces, and
+// CapturePanicStack, CaptureHeaderOrder and MeasurePeakHeap are set
+// if they are set in any of them. The Name, Enabled, Compose,
+// ComposeOrder, ComposeTrace, SlowHook, HookBudget, Async,
+// AsyncBuffer, AsyncFullPolicy, CountHooks and Client fields of the
+// traces are ignored.
+func Multiplex(traces ...*ServerTrace) *ServerTrace {
+	m := new(ServerTrace)
+	for i, t := range traces {
+		m.StallThreshold = minThreshold(m.StallThreshold, t.StallThreshold)
+		m.WriteBlockThreshold = minThreshold(m.WriteBlockThreshold, t.WriteBlockThreshold)
+		if m.CaptureResponseBody < t.CaptureResponseBody {
+			m.CaptureResponseBody = t.CaptureResponseBody
+		}
+		if i == 0 || m.MaxChunkHooks != 0 && (t.MaxChunkHooks == 0 || m.MaxChunkHooks < t.MaxChunkHooks) {
+			m.MaxChunkHooks = t.MaxChunkHooks
+		}
+		if m.SingleValueHeaders == nil {
+			m.SingleValueHeaders = t.SingleValueHeaders
+		}
+		if m.ContextKeys == nil {
+			m.ContextKeys = t.ContextKeys
+		}
+		m.CapturePanicStack = m.CapturePanicStack || t.CapturePanicStack
+		m.CaptureHeaderOrder = m.CaptureHeaderOrder || t.CaptureHeaderOrder
+		m.MeasurePeakHeap = m.MeasurePeakHeap || t.MeasurePeakHeap
+	}
+	mv := reflect.ValueOf(m).Elem()
+	structType := mv.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		if !isHook(structType.Field(i)) {
+			continue
+		}
+		name := structType.Field(i).Name
+		var hooks []reflect.Value
+		var onPanics []func(string, interface{})
+		for _, t := range traces {
+			hook := reflect.ValueOf(t).Elem().Field(i)
+			if hook.IsNil() {
+				continue
+			}
+			hooks = append(hooks, hook)
+			onPanics = append(onPanics, t.OnHookPanic)
+		}
+		if len(hooks) == 0 {
+			continue
+		}
+		hookType := mv.Field(i).Type()
+		mv.Field(i).Set(reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+			var p interface{}
+			for i, hook := range hooks {
+				if v := callIsolated(name, hook, args, onPanics[i]); p == nil {
+					p = v
+				}
+			}
+			if p != nil {
+				panic(p)
+			}
+			return zeroResults(hookType)
+		}))
+	}
+	return m
+}
+
+// AddHook adds fn to the hook of t with the given name, such as
+// "WroteBodyChunk", so that fn is called after the functions already
+// set for the hook. Each function is called in isolation, as with
+// Multiplex: a panic in one does not prevent the others from being
+// called. It is recovered and reported to t's OnHookPanic, if set,
+// or otherwise resumed once the others have been called, as if the
+// function had been set directly. AddHook panics if t has no hook with the given name or if
+// fn is not a function of the hook's type.
+//
+// AddHook must not be called once t has been installed with
+// WithServerTrace or http.Server.Trace.
+func (t *ServerTrace) AddHook(name string, fn interface{}) {
+	f, ok := reflect.TypeOf(t).Elem().FieldByName(name)
+	if !ok || !isHook(f) {
+		panic("httptrace: unknown hook " + name)
+	}
+	fv := reflect.ValueOf(fn)
+	if !fv.IsValid() || fv.Type() != f.Type || fv.IsNil() {
+		panic("httptrace: " + name + " hook must be a non-nil " + f.Type.String())
+	}
+	field := reflect.ValueOf(t).Elem().FieldByIndex(f.Index)
+	var hooks []reflect.Value
+	if !field.IsNil() {
+		hooks = append(hooks, reflect.ValueOf(field.Interface()))
+	}
+	hooks = append(hooks, fv)
+	field.Set(reflect.MakeFunc(f.Type, func(args []reflect.Value) []reflect.Value {
+		var p interface{}
+		for _, hook := range hooks {
+			if v := callIsolated(name, hook, args, t.OnHookPanic); p == nil {
+				p = v
+			}
+		}
+		if p != nil {
+			panic(p)
+		}
+		return zeroResults(f.Type)
+	}))
+}
+
+// callIsolated calls hook with args, recovering any panic and
+// reporting it to onPanic. If onPanic is nil, it returns the value
+// passed to panic instead, for the caller to panic with.
+func callIsolated(name string, hook reflect.Value, args []reflect.Value, onPanic func(string, interface{})) (panicked interface{}) {
+	defer func() {
+		if v := recover(); v != nil {
+			if onPanic == nil {
+				panicked = v
+				return
+			}
+			onPanic(name, v)
+		}
+	}()
+	hook.Call(args)
+	return nil
+}
+
+// minThreshold returns the smaller of a and b, ignoring zero values.
+func minThreshold(a, b time.Duration) time.Duration {
+	if a == 0 || b != 0 && b < a {
+		return b
+	}
+	return a
+}
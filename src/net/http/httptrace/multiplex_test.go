@@ -0,0 +1,143 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiplex(t *testing.T) {
+	var got []string
+	var panicked []string
+	logger := &ServerTrace{
+		WroteHeader: func(WroteHeaderInfo) {
+			got = append(got, "logger")
+		},
+	}
+	debugger := &ServerTrace{
+		WroteHeader: func(WroteHeaderInfo) {
+			panic("debugger bug")
+		},
+		OnHookPanic: func(hook string, v interface{}) {
+			panicked = append(panicked, hook)
+		},
+		StallThreshold: 2 * time.Second,
+	}
+	metrics := &ServerTrace{
+		WroteHeader: func(WroteHeaderInfo) {
+			got = append(got, "metrics")
+		},
+		HandlerDone: func(HandlerDoneInfo) {
+			got = append(got, "metrics.HandlerDone")
+		},
+		StallThreshold: time.Second,
+	}
+	m := Multiplex(logger, debugger, metrics)
+	m.WroteHeader(WroteHeaderInfo{})
+	m.HandlerDone(HandlerDoneInfo{})
+	if want := []string{"logger", "metrics", "metrics.HandlerDone"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %q; want %q", got, want)
+	}
+	if want := []string{"WroteHeader"}; !reflect.DeepEqual(panicked, want) {
+		t.Errorf("OnHookPanic calls = %q; want %q", panicked, want)
+	}
+	if m.GotRequest != nil {
+		t.Error("GotRequest set though no trace sets it")
+	}
+	if m.StallThreshold != time.Second {
+		t.Errorf("StallThreshold = %v; want %v", m.StallThreshold, time.Second)
+	}
+}
+
+func TestAddHook(t *testing.T) {
+	var got []string
+	var panicked []string
+	trace := &ServerTrace{
+		WroteBodyChunk: func(info WroteBodyChunkInfo) {
+			got = append(got, fmt.Sprintf("first %d", info.Len))
+		},
+		OnHookPanic: func(hook string, v interface{}) {
+			panicked = append(panicked, hook)
+		},
+	}
+	trace.AddHook("WroteBodyChunk", func(info WroteBodyChunkInfo) {
+		got = append(got, fmt.Sprintf("second %d", info.Len))
+		panic("second")
+	})
+	trace.AddHook("WroteBodyChunk", func(info WroteBodyChunkInfo) {
+		got = append(got, fmt.Sprintf("third %d", info.Len))
+	})
+
+	trace.WroteBodyChunk(WroteBodyChunkInfo{Len: 1})
+	trace.WroteBodyChunk(WroteBodyChunkInfo{Len: 2})
+	want := []string{"first 1", "second 1", "third 1", "first 2", "second 2", "third 2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %q; want %q", got, want)
+	}
+	if want := []string{"WroteBodyChunk", "WroteBodyChunk"}; !reflect.DeepEqual(panicked, want) {
+		t.Errorf("OnHookPanic calls = %q; want %q", panicked, want)
+	}
+}
+
+func TestAddHookNoOnHookPanic(t *testing.T) {
+	var got []string
+	trace := &ServerTrace{
+		WroteHeader: func(WroteHeaderInfo) {
+			got = append(got, "first")
+			panic("first")
+		},
+	}
+	trace.AddHook("WroteHeader", func(WroteHeaderInfo) {
+		got = append(got, "second")
+		panic("second")
+	})
+	func() {
+		defer func() {
+			if v := recover(); v != "first" {
+				t.Errorf("WroteHeader panicked with %v; want %q", v, "first")
+			}
+		}()
+		trace.WroteHeader(WroteHeaderInfo{})
+	}()
+	if want := []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("calls = %q; want %q", got, want)
+	}
+
+	m := Multiplex(&ServerTrace{
+		HandlerDone: func(HandlerDoneInfo) { panic("multiplexed") },
+	})
+	defer func() {
+		if v := recover(); v != "multiplexed" {
+			t.Errorf("multiplexed HandlerDone panicked with %v; want %q", v, "multiplexed")
+		}
+	}()
+	m.HandlerDone(HandlerDoneInfo{})
+}
+
+func TestAddHookInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   interface{}
+	}{
+		{"NoSuchHook", func() {}},
+		{"OnHookPanic", func(string, interface{}) {}},
+		{"WroteBodyChunk", func(int) {}},
+		{"WroteBodyChunk", nil},
+		{"WroteBodyChunk", (func(WroteBodyChunkInfo))(nil)},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("AddHook(%q, %T) did not panic", tt.name, tt.fn)
+				}
+			}()
+			new(ServerTrace).AddHook(tt.name, tt.fn)
+		}()
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NegotiateEncoding returns the content coding, among supported, that
+// a response should be encoded with for a request with the given
+// Accept-Encoding header, or "" if the client accepts none of them.
+// Of the supported codings the client accepts, it chooses the one
+// with the highest quality value, preferring earlier ones in
+// supported on ties. A "*" in the header matches any coding it does
+// not list. Codings are compared case-insensitively and supported
+// must be lower case.
+//
+// NegotiateEncoding calls the NegotiatedEncoding hook of trace, if
+// any, with the codings listed in the header and the chosen one.
+func NegotiateEncoding(acceptEncoding string, supported []string, trace *ServerTrace) string {
+	var requested []string
+	qs := make(map[string]float64)
+	for _, field := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(field, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if len(p) > 2 && (p[0] == 'q' || p[0] == 'Q') && p[1] == '=' {
+				v, err := strconv.ParseFloat(p[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		requested = append(requested, coding)
+		if _, dup := qs[coding]; !dup {
+			qs[coding] = q
+		}
+	}
+
+	var chosen string
+	var best float64
+	for _, s := range supported {
+		q, ok := qs[s]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > best {
+			chosen, best = s, q
+		}
+	}
+	if trace != nil && trace.NegotiatedEncoding != nil && trace.IsEnabled(ResponseHooks) {
+		trace.NegotiatedEncoding(requested, chosen)
+	}
+	return chosen
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"reflect"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		header    string
+		supported []string
+		want      string
+	}{
+		{"gzip, br", []string{"gzip"}, "gzip"},
+		{"gzip, br", []string{"br", "gzip"}, "br"},
+		{"gzip;q=0.5, br", []string{"gzip", "br"}, "br"},
+		{"GZIP", []string{"gzip"}, "gzip"},
+		{"br;q=0", []string{"br"}, ""},
+		{"*;q=0.1, gzip;q=0", []string{"gzip", "deflate"}, "deflate"},
+		{"", []string{"gzip"}, ""},
+	}
+	for _, tt := range tests {
+		if got := NegotiateEncoding(tt.header, tt.supported, nil); got != tt.want {
+			t.Errorf("NegotiateEncoding(%q, %q) = %q; want %q", tt.header, tt.supported, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiatedEncodingHook(t *testing.T) {
+	type negotiation struct {
+		requested []string
+		chosen    string
+	}
+	got := make(chan negotiation, 1)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		trace := ContextServerTrace(r.Context())
+		if enc := NegotiateEncoding(r.Header.Get("Accept-Encoding"), []string{"gzip"}, trace); enc != "" {
+			w.Header().Set("Content-Encoding", enc)
+		}
+	}))
+	ts.Config.Trace = &ServerTrace{
+		NegotiatedEncoding: func(requested []string, chosen string) {
+			got <- negotiation{requested, chosen}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if ce := res.Header.Get("Content-Encoding"); ce != "gzip" {
+		t.Errorf("Content-Encoding = %q; want %q", ce, "gzip")
+	}
+	n := <-got
+	if want := []string{"gzip", "br"}; !reflect.DeepEqual(n.requested, want) {
+		t.Errorf("requested = %q; want %q", n.requested, want)
+	}
+	if n.chosen != "gzip" {
+		t.Errorf("chosen = %q; want %q", n.chosen, "gzip")
+	}
+}
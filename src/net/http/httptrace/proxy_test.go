@@ -0,0 +1,91 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServerTraceClient(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu     sync.Mutex
+		events []string
+	)
+	record := func(name string) {
+		mu.Lock()
+		events = append(events, name)
+		mu.Unlock()
+	}
+	done := make(chan bool, 1)
+	proxy := httptest.NewUnstartedServer(httputil.NewSingleHostReverseProxy(backendURL))
+	proxy.Config.Trace = &ServerTrace{
+		GotRequest: func(RequestInfo) {
+			record("server.GotRequest")
+		},
+		WroteHeader: func(WroteHeaderInfo) {
+			record("server.WroteHeader")
+		},
+		HandlerDone: func(HandlerDoneInfo) {
+			record("server.HandlerDone")
+			done <- true
+		},
+		Client: &ClientTrace{
+			GetConn: func(string) {
+				record("client.GetConn")
+			},
+			WroteRequest: func(WroteRequestInfo) {
+				record("client.WroteRequest")
+			},
+			GotFirstResponseByte: func() {
+				record("client.GotFirstResponseByte")
+			},
+		},
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	res, err := proxy.Client().Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandlerDone not called")
+	}
+
+	want := []string{
+		"server.GotRequest",
+		"client.GetConn",
+		"client.WroteRequest",
+		"client.GotFirstResponseByte",
+		"server.WroteHeader",
+		"server.HandlerDone",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q; want %q", events, want)
+	}
+}
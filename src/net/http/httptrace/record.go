@@ -0,0 +1,104 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"reflect"
+	"sync"
+)
+
+// A RecordedEvent is a single ServerTrace hook call captured by a
+// Recording.
+type RecordedEvent struct {
+	// Hook is the name of the ServerTrace field that was called,
+	// such as "GotRequest".
+	Hook string
+
+	// Args holds the arguments of the call. For most hooks, it
+	// holds a single Info struct.
+	Args []interface{}
+}
+
+// A Recording is an ordered log of ServerTrace hook calls. It is
+// created by RecordingTrace.
+type Recording struct {
+	mu     sync.Mutex
+	events []RecordedEvent
+}
+
+// RecordingTrace returns a ServerTrace with every hook set, and the
+// Recording to which its hook calls are appended. The maps and slices
+// in the arguments, such as WroteHeaderInfo.Header, are copied, so the
+// recording does not change when the handler goes on to modify them.
+// Hooks that also require a threshold, such as BodyReadStall, are not
+// called until the threshold is set on the returned trace.
+//
+// Combined with Replay, RecordingTrace lets the hooks of another trace
+// be exercised without running a server.
+func RecordingTrace() (*ServerTrace, *Recording) {
+	rec := new(Recording)
+	t := new(ServerTrace)
+	tv := reflect.ValueOf(t).Elem()
+	structType := tv.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		f := tv.Field(i)
+		hookType := f.Type()
+		if !isHook(structType.Field(i)) {
+			continue
+		}
+		name := structType.Field(i).Name
+		f.Set(reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+			ev := RecordedEvent{Hook: name, Args: make([]interface{}, len(args))}
+			for i, arg := range copyArgs(args) {
+				ev.Args[i] = arg.Interface()
+			}
+			rec.mu.Lock()
+			rec.events = append(rec.events, ev)
+			rec.mu.Unlock()
+			return zeroResults(hookType)
+		}))
+	}
+	return t, rec
+}
+
+// Events returns a copy of the events recorded so far, in the order
+// in which they occurred.
+func (r *Recording) Events() []RecordedEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]RecordedEvent(nil), r.events...)
+}
+
+// Replay calls the hooks of target with the recorded events, in the
+// order in which they were recorded. Events for hooks that are nil in
+// target are skipped.
+func (r *Recording) Replay(target *ServerTrace) {
+	tv := reflect.ValueOf(target).Elem()
+	for _, ev := range r.Events() {
+		f := tv.FieldByName(ev.Hook)
+		if !f.IsValid() || f.Kind() != reflect.Func || f.IsNil() {
+			continue
+		}
+		hookType := f.Type()
+		args := make([]reflect.Value, len(ev.Args))
+		for i, arg := range ev.Args {
+			if arg == nil {
+				args[i] = reflect.Zero(hookType.In(i))
+			} else {
+				args[i] = reflect.ValueOf(arg)
+			}
+		}
+		f.Call(args)
+	}
+}
+
+// zeroResults returns the zero values of the results of funcType.
+func zeroResults(funcType reflect.Type) []reflect.Value {
+	results := make([]reflect.Value, funcType.NumOut())
+	for i := range results {
+		results[i] = reflect.Zero(funcType.Out(i))
+	}
+	return results
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRecordingTrace(t *testing.T) {
+	trace, rec := RecordingTrace()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "hello")
+	}))
+	ts.Config.Trace = trace
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// HandlerDone is called after the response is flushed.
+	for i := 0; len(rec.Events()) == 0 || rec.Events()[len(rec.Events())-1].Hook != "HandlerDone"; i++ {
+		if i == 100 {
+			t.Fatalf("HandlerDone not recorded; events = %+v", rec.Events())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Other hooks are recorded too; check the order of the
+	// ones that matter to the replay below.
+	var hooks []string
+	for _, ev := range rec.Events() {
+		switch ev.Hook {
+		case "GotRequest", "WroteHeader", "WroteBodyChunk", "HandlerDone":
+			hooks = append(hooks, ev.Hook)
+		}
+	}
+	want := []string{"GotRequest", "WroteHeader", "WroteBodyChunk", "HandlerDone"}
+	if !reflect.DeepEqual(hooks, want) {
+		t.Fatalf("recorded %q; want %q", hooks, want)
+	}
+
+	var replayed []string
+	var status int
+	var chunk WroteBodyChunkInfo
+	target := &ServerTrace{
+		GotRequest: func(RequestInfo) {
+			replayed = append(replayed, "GotRequest")
+		},
+		WroteHeader: func(info WroteHeaderInfo) {
+			status = info.StatusCode
+			replayed = append(replayed, "WroteHeader")
+		},
+		WroteBodyChunk: func(info WroteBodyChunkInfo) {
+			chunk = info
+			replayed = append(replayed, "WroteBodyChunk")
+		},
+		HandlerDone: func(HandlerDoneInfo) {
+			replayed = append(replayed, "HandlerDone")
+		},
+	}
+	rec.Replay(target)
+	want = []string{"GotRequest", "WroteHeader", "WroteBodyChunk", "HandlerDone"}
+	if !reflect.DeepEqual(replayed, want) {
+		t.Errorf("replayed %q; want %q", replayed, want)
+	}
+	if status != http.StatusAccepted {
+		t.Errorf("replayed status = %d; want %d", status, http.StatusAccepted)
+	}
+	if chunk.Len != 5 || chunk.Err != nil {
+		t.Errorf("replayed chunk = %+v; want Len 5 and nil Err", chunk)
+	}
+}
+
+func TestRecordingTraceCopiesArgs(t *testing.T) {
+	trace, rec := RecordingTrace()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Foo", "before")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("X-Foo", "after")
+		w.Header().Set("X-Bar", "after")
+	}))
+	ts.Config.Trace = trace
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	for _, ev := range rec.Events() {
+		if ev.Hook != "WroteHeader" {
+			continue
+		}
+		h := http.Header(ev.Args[0].(WroteHeaderInfo).Header)
+		if got := h.Get("X-Foo"); got != "before" {
+			t.Errorf("recorded X-Foo = %q; want %q", got, "before")
+		}
+		if _, ok := h["X-Bar"]; ok {
+			t.Errorf("recorded header has X-Bar, set after WriteHeader")
+		}
+		return
+	}
+	t.Fatalf("WroteHeader not recorded; events = %+v", rec.Events())
+}
@@ -0,0 +1,1565 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// unique type to prevent assignment.
+type serverEventContextKey struct{}
+
+// ContextServerTrace returns the ServerTrace associated with the
+// provided context. If none, it returns nil.
+func ContextServerTrace(ctx context.Context) *ServerTrace {
+	trace, _ := ctx.Value(serverEventContextKey{}).(*ServerTrace)
+	return trace
+}
+
+// WithServerTrace returns a new context based on the provided parent
+// ctx. The returned context carries the provided trace hooks, in
+// addition to any previous hooks registered with ctx. Where both set
+// a hook, the order in which they are called is given by trace's
+// Compose, NewFirst by default, or its ComposeOrder entry for the
+// hook. WithServerTrace panics if ComposeOrder has a key that is not
+// the name of a hook.
+//
+// If trace itself, or a trace with the same non-empty Name, is already
+// registered with ctx, WithServerTrace returns ctx unmodified, so that
+// its hooks are not called twice. Distinct traces whose hooks are set
+// to the same function value each call it.
+//
+// WithServerTrace does not modify trace. The returned context carries
+// a copy of it, composed with the previous hooks, which is what
+// ContextServerTrace returns. The same trace may therefore be
+// installed in many contexts, concurrently.
+//
+// An HTTP server installs its own trace (see http.Server.Trace) in
+// the context of each request it serves. Handlers may use
+// WithServerTrace to add hooks for the remainder of a request.
+func WithServerTrace(ctx context.Context, trace *ServerTrace) context.Context {
+	if trace == nil {
+		panic("nil trace")
+	}
+	old := ContextServerTrace(ctx)
+	if old.installed(trace) {
+		return ctx
+	}
+	if err := checkComposeOrder(trace.ComposeOrder); err != nil {
+		panic(err)
+	}
+	if trace.orig == nil && trace.CountHooks {
+		// Create the counters before copying trace, so its
+		// installed copies all share them.
+		trace.counters()
+	}
+	t := *trace
+	t.orig = trace
+	if trace.orig != nil {
+		t.orig = trace.orig
+	}
+	t.compose(old)
+	if t.Client != nil {
+		ctx = WithClientTrace(ctx, t.Client)
+	}
+	return context.WithValue(ctx, serverEventContextKey{}, &t)
+}
+
+// WithoutServerTrace returns a new context based on the provided
+// parent ctx in which ContextServerTrace returns nil, hiding any trace
+// registered with ctx. It lets a handler carve out a region, such as
+// a sensitive sub-request, that code using the request's context does
+// not trace. Traces later registered with the returned context with
+// WithServerTrace are not composed with the hidden trace.
+//
+// The server keeps calling the hooks of the trace it installed for
+// the request itself, regardless of the handler's contexts.
+func WithoutServerTrace(ctx context.Context) context.Context {
+	if ContextServerTrace(ctx) == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, serverEventContextKey{}, (*ServerTrace)(nil))
+}
+
+// ServerTrace is a set of hooks to run at various stages of serving
+// an incoming HTTP request. Any particular hook may be nil. Functions
+// may be called concurrently from different goroutines and some may
+// be called after the handler has returned.
+//
+// ServerTrace currently traces only HTTP/1.x requests.
+type ServerTrace struct {
+	// Name optionally identifies the trace. A trace with a
+	// non-empty Name is installed at most once in a chain of
+	// contexts, so that installing the same trace twice does not
+	// call its hooks twice.
+	Name string
+
+	// Enabled is the set of hook categories whose hooks are
+	// called. If zero, all hooks are called. To change Enabled
+	// while the trace is in use, use SetEnabled.
+	Enabled HookCategory
+
+	// Compose is the order in which WithServerTrace calls the
+	// hooks of this trace relative to those of a previously
+	// registered trace.
+	Compose ComposePolicy
+
+	// ComposeOrder optionally overrides Compose for individual
+	// hooks. It is keyed by hook name, such as "WroteHeader";
+	// WithServerTrace panics if a key is not the name of a hook.
+	ComposeOrder map[string]ComposePolicy
+
+	// OnHookPanic, if non-nil, is called when one of the trace's
+	// hooks panics, with the name of the hook, such as
+	// "WroteHeader", and the value passed to panic. The panic is
+	// recovered and the hook returns normally. OnHookPanic only
+	// applies once the trace has been installed with
+	// WithServerTrace, as the server does with http.Server.Trace.
+	// If OnHookPanic is nil, the trace uses the OnHookPanic of the
+	// trace it is composed with, if any. It covers only the hooks
+	// set in the trace itself: a panic in a hook taken from the
+	// trace it is composed with is handled by that trace.
+	OnHookPanic func(hook string, v interface{})
+
+	// ComposeTrace, if non-nil, is called by WithServerTrace for
+	// each hook that is set in the trace being installed or in the
+	// trace it is composed with, describing how the two were
+	// merged. It is a diagnostic aid for debugging middleware that
+	// installs traces. If ComposeTrace is nil, the trace uses the
+	// ComposeTrace of the trace it is composed with, if any.
+	ComposeTrace func(ComposeInfo)
+
+	// SlowHook, if non-nil, is called when one of the trace's
+	// hooks takes longer than HookBudget, with the name of the
+	// hook and how long it took. As hooks run on the goroutines
+	// serving requests, slow hooks add to the server's latency.
+	// Only the hooks set in the trace itself are timed, not those
+	// taken from the trace it is composed with, which that trace
+	// times. Like OnHookPanic, SlowHook only applies once the
+	// trace has been installed with WithServerTrace, and is
+	// inherited from the trace it is composed with if nil.
+	SlowHook func(hook string, d time.Duration)
+
+	// HookBudget is how long a hook may run before SlowHook is
+	// called. SlowHook is not called if HookBudget is zero.
+	HookBudget time.Duration
+
+	// Async causes the trace's hooks to be called in order on a
+	// background goroutine rather than on the goroutines serving
+	// requests, so that slow hooks do not add to the server's
+	// latency. Each call is queued with a deep copy of its
+	// arguments, including the maps and slices they contain, such
+	// as response headers, which the handler may go on changing.
+	// Values referred to by pointers and interfaces, such as
+	// errors, are not copied. As hooks then run on a goroutine of
+	// their own, a hook that panics crashes the program unless
+	// OnHookPanic is set. Like OnHookPanic, Async only applies once
+	// the trace has been installed with WithServerTrace. It is not
+	// inherited by traces composed with the trace.
+	Async bool
+
+	// AsyncBuffer is the number of hook calls an Async trace
+	// queues. If zero, a default size is used.
+	AsyncBuffer int
+
+	// AsyncFullPolicy is what an Async trace does with a hook call
+	// when its queue is full: wait for room, stalling the server,
+	// or drop the call.
+	AsyncFullPolicy FullPolicy
+
+	// CountHooks causes the trace to count the calls of each of
+	// its hooks, as reported by Stats. Like OnHookPanic, it only
+	// applies once the trace has been installed with
+	// WithServerTrace.
+	CountHooks bool
+
+	// Client optionally traces the outgoing requests of handlers,
+	// such as proxies, that make requests using the context of the
+	// request they serve. WithServerTrace installs Client in the
+	// returned context with WithClientTrace, so the hooks of both
+	// traces are called for a proxied request, in the order in
+	// which the events happen.
+	Client *ClientTrace
+
+	// ServeStart is called when http.Server.Serve starts accepting
+	// connections, with the address of its listener. It is called
+	// once for each listener served. ServeShutdown is called when
+	// http.Server.Shutdown or Close returns, with the error they
+	// return. Because they concern the server rather than a
+	// request, they are only called for traces installed for the
+	// whole server, with http.Server.Trace.
+	ServeStart    func(net.Addr)
+	ServeShutdown func(error)
+
+	// TLSHandshakeError is called when the TLS handshake of a new
+	// connection fails, before the server drops the connection.
+	// As no request has been read, it is only called for traces
+	// installed for the whole server, with http.Server.Trace.
+	TLSHandshakeError func(error)
+
+	// ProtocolNegotiated is called once per connection with the
+	// protocol the connection is served with: the protocol
+	// negotiated by TLS ALPN or NPN, such as "h2", for which the
+	// server has a http.Server.TLSNextProto handler, or
+	// "http/1.1" for connections served with HTTP/1.x. It is
+	// called before the TLSNextProto handler takes over the
+	// connection. The other hooks are not called for such
+	// connections.
+	ProtocolNegotiated func(proto string)
+
+	// SocketOptions is called once per connection, before any
+	// TLS handshake, with the socket options in effect for the
+	// connection. It is only called for connections whose
+	// net.Conn is a *net.TCPConn, and currently only on Linux.
+	SocketOptions func(SocketOptionsInfo)
+
+	// ReadFirstByte is called with the time the server read the
+	// first byte of a new request from the connection. The time
+	// between a connection becoming idle or being accepted and
+	// ReadFirstByte is the time the client took to send the
+	// request.
+	ReadFirstByte func(time.Time)
+
+	// GotMethod is called with the method of a request as soon as
+	// the server has parsed its request line and headers, before
+	// the server validates the rest of the request. It lets
+	// unusual methods, such as PROPFIND, be observed even for
+	// requests the server goes on to reject.
+	GotMethod func(string)
+
+	// GotRequest is called after the server has read a request's
+	// headers, before the request is passed to its handler.
+	GotRequest func(RequestInfo)
+
+	// EffectiveDeadline is called after GotRequest with the
+	// earliest of the deadlines that apply to a request, set by
+	// http.Server.ReadTimeout and WriteTimeout, if any. It is
+	// called again when an http.TimeoutHandler serving the
+	// request has an earlier time limit, if the TimeoutHandler
+	// is passed the server's ResponseWriter.
+	EffectiveDeadline func(DeadlineSourceInfo)
+
+	// CaptureHeaderOrder causes the names of a request's header
+	// fields to be reported, as sent and in order, in
+	// RequestInfo.RawHeaderOrder. Capturing them makes reading
+	// request headers slower.
+	CaptureHeaderOrder bool
+
+	// GotQuery is called after GotRequest for requests with a
+	// query string, with the result of parsing it as
+	// url.ParseQuery does. The error is that of the first
+	// malformed parameter, if any, which the handler's
+	// Request.URL.Query and Request.ParseForm would ignore or
+	// report only later.
+	GotQuery func(map[string][]string, error)
+
+	// GotCookie is called after GotRequest with the name and
+	// value of each cookie in the request's Cookie headers, in
+	// the order in which they appear, as returned by
+	// http.Request.Cookies.
+	GotCookie func(name, value string)
+
+	// GotTraceContext is called after GotRequest for requests with
+	// a traceparent header, as defined by the W3C Trace Context
+	// specification, with the values of the request's traceparent
+	// and tracestate headers. Tracestate is empty if the request
+	// has none. The values are not parsed or validated.
+	GotTraceContext func(traceparent, tracestate string)
+
+	// TargetNormalized is called after GotRequest for requests
+	// whose path, as sent in an origin-form request-target, differs
+	// from the path in the request's URL, with the path as sent
+	// and the path the handler sees. The server percent-decodes
+	// the path, so "/a/%2e%2e/b" becomes "/a/../b"; it does not
+	// resolve dot-segments, which http.ServeMux does (see
+	// PathCleaned).
+	TargetNormalized func(original, normalized string)
+
+	// GotAbsoluteURI is called after GotRequest for requests
+	// whose request-target is in absolute form, such as
+	// "http://example.com/path", with the request-target. Clients
+	// send such requests to proxies. The server serves them like
+	// other requests; the handler sees the URI's host and path in
+	// the request's URL.
+	GotAbsoluteURI func(string)
+
+	// GotAuthScheme is called after GotRequest for requests with
+	// an Authorization header with the header's authentication
+	// scheme, such as "Basic" or "Bearer", as sent. The
+	// credentials that follow the scheme are never passed to the
+	// hook.
+	GotAuthScheme func(scheme string)
+
+	// GotServerOptions is called when the server receives an
+	// "OPTIONS *" request, which asks about the server as a whole
+	// rather than a resource. The server answers such requests
+	// itself, without calling the Server's Handler.
+	GotServerOptions func()
+
+	// GotContextKeys is called after GotRequest with the names of
+	// the keys in ContextKeys for which the request's context has
+	// a value, in sorted order. As context keys cannot be
+	// enumerated, only the keys in ContextKeys are checked.
+	// Looking them up takes time proportional to the depth of the
+	// context for each key, so GotContextKeys is intended for
+	// debugging. It is not called if ContextKeys is empty.
+	//
+	// The context is the one the server passes to the handler;
+	// values that middleware handlers add to it later are not
+	// seen.
+	GotContextKeys func(present []string)
+
+	// ContextKeys maps names of context keys, as reported to
+	// GotContextKeys, to the keys.
+	ContextKeys map[string]interface{}
+
+	// PathCleaned is called when an http.ServeMux cleans the path
+	// of a request, collapsing repeated slashes and resolving "."
+	// and ".." elements, and the cleaned path differs from the
+	// original. The mux then redirects the client to the cleaned
+	// path.
+	PathCleaned func(original, cleaned string)
+
+	// BodyReadStall is called when a single Read of a request
+	// body has been blocked for longer than StallThreshold. It
+	// is called at most once per Read, while that Read is still
+	// blocked, and is useful for detecting clients that trickle
+	// their request bodies. BodyReadStall is not called if
+	// StallThreshold is zero.
+	BodyReadStall func(BodyReadStallInfo)
+
+	// StallThreshold is how long a request body Read may block
+	// before BodyReadStall is called.
+	StallThreshold time.Duration
+
+	// BodyReadComplete is called once reading a request body
+	// ends, by the handler or by the server on its behalf, with
+	// the number of body bytes read. Clean reports whether the
+	// body ended where its Content-Length or chunked encoding
+	// said it would; it is false if the client closed the
+	// connection or stopped sending before then. It is not
+	// called for requests without a body or whose body is not
+	// read to its end.
+	BodyReadComplete func(clean bool, total int64)
+
+	// GotRequestTrailers is called with the trailer fields that
+	// follow a chunked request body, once the handler, or the
+	// server on its behalf, has read the body to its end. It is
+	// not called if the body has no trailer fields.
+	GotRequestTrailers func(map[string][]string)
+
+	// BodyLimitExceeded is called with the limit of an
+	// http.MaxBytesReader wrapping the request body when the
+	// client sends more than limit bytes. It is only called if
+	// the MaxBytesReader was created with the ResponseWriter the
+	// server passed to the handler.
+	BodyLimitExceeded func(limit int64)
+
+	// DecompressedRequest is called when a request body wrapped
+	// with NewDecompressingBody has been read to its end or
+	// closed, with the body's content encoding and the number of
+	// compressed and decompressed bytes read.
+	DecompressedRequest func(encoding string, compressed, decompressed int64)
+
+	// GotRequestBodyType is called with the content type of a
+	// request body wrapped with http.SniffingBody, as determined
+	// from its first 512 bytes by http.DetectContentType, when the
+	// handler first reads the body.
+	GotRequestBodyType func(string)
+
+	// WroteHeader is called when the handler writes the
+	// response header, either explicitly with WriteHeader or
+	// implicitly with its first Write.
+	WroteHeader func(WroteHeaderInfo)
+
+	// CacheHeaders is called after WroteHeader with the
+	// caching-related headers of the response.
+	CacheHeaders func(CacheInfo)
+
+	// Redirected is called when the handler responds with a 3xx
+	// status code and a Location header, as http.Redirect and the
+	// redirects of http.ServeMux and http.FileServer do.
+	Redirected func(RedirectInfo)
+
+	// ProxyBackendDone is called when a handler that is an
+	// httputil.ReverseProxy has received the response header of
+	// the request it sent to its backend, or failed to. Because
+	// ReverseProxy is a handler, ProxyBackendDone is called from
+	// the trace in the request's context.
+	ProxyBackendDone func(ProxyInfo)
+
+	// ConditionalResult is called when http.ServeContent, or
+	// http.FileServer or http.ServeFile, which use it, evaluates
+	// the preconditions of a conditional request, such as one with
+	// an If-None-Match header. Because ServeContent runs in the
+	// handler, ConditionalResult is called from the trace in the
+	// request's context.
+	ConditionalResult func(ConditionalInfo)
+
+	// IfRangeEvaluated is called when http.ServeContent evaluates
+	// the If-Range header of a request that also has a Range
+	// header. It reports whether the precondition was satisfied,
+	// in which case the range is served; otherwise the whole
+	// content is. Like ConditionalResult, it is called from the
+	// trace in the request's context.
+	IfRangeEvaluated func(satisfied bool)
+
+	// MethodNotAllowed is called when the handler responds with
+	// 405 Method Not Allowed, with the methods listed in the
+	// response's Allow header. The server itself never responds
+	// with 405; such responses come from handlers that route by
+	// method.
+	MethodNotAllowed func(allowed []string)
+
+	// DuplicateHeader is called when the handler writes the
+	// response header, for each header in SingleValueHeaders that
+	// has more than one value, with the header's name and values.
+	// The server sends every value, which for such headers is
+	// usually a bug in the handler.
+	DuplicateHeader func(name string, values []string)
+
+	// SingleValueHeaders lists the response headers that
+	// DuplicateHeader expects to have a single value. If nil, a
+	// default set of headers is used, including Content-Type,
+	// Content-Length and Location.
+	SingleValueHeaders []string
+
+	// SniffedContentType is called with the Content-Type the
+	// server detected from the start of the response body, when
+	// the handler did not set one itself.
+	SniffedContentType func(string)
+
+	// WroteDate is called with the time the server used for the
+	// Date header it adds to responses whose handler did not set
+	// one. The header itself has a precision of one second.
+	WroteDate func(time.Time)
+
+	// WroteServerHeader is called with the value of the Server
+	// header of a response. The server does not add a Server
+	// header itself, so it is only called for responses whose
+	// handler set one.
+	WroteServerHeader func(string)
+
+	// AutoChunked is called when the server sends an HTTP/1.1
+	// response with the chunked Transfer-Encoding because the
+	// handler did not set a Content-Length and the server could
+	// not compute one, as when the handler flushes its response or
+	// writes more than the server buffers. It is not called when
+	// the handler itself set "Transfer-Encoding: chunked".
+	AutoChunked func()
+
+	// HeaderSanitized is called for each value of a response
+	// header that contains a CR or LF character, with the header's
+	// name and the original value. The server replaces such
+	// characters with spaces when writing the header, so that a
+	// handler cannot inject headers of its own.
+	HeaderSanitized func(name, original string)
+
+	// NoContentLength is called when a response has been
+	// written without a Content-Length, its body being framed by
+	// chunked encoding or by closing the connection. Downstream
+	// caches handle such responses less efficiently, so a
+	// handler that knows its body's length may want to set it.
+	NoContentLength func(NoContentLengthInfo)
+
+	// NegotiatedEncoding is called by NegotiateEncoding with the
+	// content codings listed in the request's Accept-Encoding
+	// header and the one chosen for the response, or "" if none
+	// was. Because negotiation is done by handlers, the hook is
+	// called from the trace passed to NegotiateEncoding, typically
+	// the one in the request's context.
+	NegotiatedEncoding func(requested []string, chosen string)
+
+	// WroteBodyChunk is called after each Write of the response
+	// body by the handler, up to MaxChunkHooks times per response.
+	WroteBodyChunk func(WroteBodyChunkInfo)
+
+	// MaxChunkHooks limits the number of WroteBodyChunk calls for
+	// each response, bounding the cost of tracing responses
+	// written in many small pieces. Writes beyond the limit are
+	// still counted in HandlerDoneInfo.BytesWritten. If
+	// MaxChunkHooks is zero, there is no limit.
+	MaxChunkHooks int
+
+	// WroteFinalChunk is called when the zero-length chunk that
+	// ends a chunked response body, and the trailers that follow
+	// it, have been written to the connection. It reports whether
+	// the response has trailers. WroteFinalChunk marks the end of
+	// the response on the wire; it is called after the handler
+	// has returned and before HandlerDone.
+	WroteFinalChunk func(hasTrailers bool)
+
+	// ResponseTruncated is called after the handler has returned
+	// if writing the response body to the connection failed, as
+	// it does when the client disconnects mid-download. It is
+	// called with the number of body bytes the handler had
+	// written when the first write failed, including any still
+	// buffered by the server, and the length of the body from
+	// its Content-Length header, or -1 if unknown.
+	ResponseTruncated func(bytesWritten, expected int64)
+
+	// HeadBodyDiscarded is called after the handler has returned
+	// with the number of response body bytes the server discarded
+	// because the request's method was HEAD, if the handler wrote
+	// any.
+	HeadBodyDiscarded func(int64)
+
+	// GotResponsePrefix is called before HandlerDone with the
+	// first CaptureResponseBody bytes of the response body, for
+	// responses with a non-empty body. It is meant for debugging
+	// small responses, such as error pages; the bytes of larger
+	// responses beyond the limit are not kept. Bodies copied
+	// from files with sendfile (see ZeroCopyUsed) are not
+	// captured. The slice must not be retained after the hook
+	// returns. GotResponsePrefix is not called if
+	// CaptureResponseBody is zero.
+	GotResponsePrefix func([]byte)
+
+	// CaptureResponseBody is the number of bytes of each
+	// response body the server keeps for GotResponsePrefix.
+	CaptureResponseBody int
+
+	// FrameRead and FrameWrite are called with the header of each
+	// WebSocket frame read from or written to a hijacked connection
+	// wrapped with NewWebSocketConn.
+	FrameRead  func(FrameInfo)
+	FrameWrite func(FrameInfo)
+
+	// ZeroCopyUsed is called when the handler copies a response
+	// body from an io.Reader using the ResponseWriter's ReadFrom
+	// method, as io.Copy and ServeContent do. It reports whether
+	// the body is copied by the kernel, with sendfile or an
+	// equivalent, rather than through a user space buffer. The
+	// kernel path is only taken for regular files, sent without
+	// chunking over unencrypted TCP connections, on systems that
+	// support it.
+	ZeroCopyUsed func(bool)
+
+	// WriteBlocked is called with the duration of a response
+	// body Write that took at least WriteBlockThreshold to
+	// complete, typically because a slow client is not reading
+	// the response and the connection's buffers are full.
+	// WriteBlocked is not called if WriteBlockThreshold is zero.
+	WriteBlocked func(time.Duration)
+
+	// WriteBlockThreshold is how long a response body Write may
+	// block before WriteBlocked is called.
+	WriteBlockThreshold time.Duration
+
+	// BufioPoolEvent is called each time the server takes a
+	// buffered reader or writer for a connection or response from
+	// its pools. Kind is "reader" or "writer", and reused reports
+	// whether a pooled buffer was reused rather than a new one
+	// allocated. Buffers are returned to the pools when the server
+	// is done with them. It is intended for investigating the
+	// server's memory use.
+	BufioPoolEvent func(kind string, reused bool)
+
+	// ConnectionReset is called when a read from or write to the
+	// connection fails because the client reset it, as opposed
+	// to closing it gracefully. Such resets are typical of
+	// clients that abandon a request or a download part way
+	// through. It is called at most once per connection.
+	ConnectionReset func()
+
+	// ConnectionLimited is called when a listener returned by
+	// NewLimitListener holds a newly accepted connection because
+	// its limit of open connections has been reached. The
+	// connection is served once another one is closed.
+	ConnectionLimited func()
+
+	// RequestsPerConnLimitReached is called when the server closes
+	// a connection because it has served the number of requests
+	// set by http.Server.MaxRequestsPerConn on it.
+	RequestsPerConnLimitReached func()
+
+	// SmugglingRejected is called when the server rejects a
+	// request because its Content-Length or Transfer-Encoding
+	// headers make its framing ambiguous, or because it has more
+	// than one Host header, which may indicate an attempt at
+	// request smuggling. A request with both a
+	// chunked Transfer-Encoding and a Content-Length is not
+	// rejected; as permitted by RFC 7230, the server ignores its
+	// Content-Length.
+	SmugglingRejected func(SmugglingInfo)
+
+	// MethodRejected is called with the method of a request that
+	// the server rejects because the method is not a valid token,
+	// along with the status code of the server's response. Methods
+	// that are valid tokens are passed to the handler, whatever
+	// they are.
+	MethodRejected func(method string, statusCode int)
+
+	// StatusChangeAttempt is called when a handler calls
+	// WriteHeader again, after the response header has been
+	// written, with a status code other than the one that was
+	// sent. The second call has no effect on the response.
+	StatusChangeAttempt func(from, to int)
+
+	// HandlerTimeout is called when a handler wrapped by
+	// http.TimeoutHandler runs for longer than its time limit
+	// and the 503 Service Unavailable response is sent in its
+	// place. Its argument is the TimeoutHandler's time limit.
+	// Because TimeoutHandler is itself a handler, HandlerTimeout
+	// is called from the trace in the request's context.
+	HandlerTimeout func(time.Duration)
+
+	// PanicAfterCommit is called when a handler panics after the
+	// response header has been written to the connection. Such a
+	// response cannot be replaced by an error, so the client
+	// receives it truncated. PanicAfterCommit is called before
+	// HandlerDone, which reports the panic in either case.
+	PanicAfterCommit func(PanicInfo)
+
+	// HijackFailed is called with the error returned by the
+	// ResponseWriter's Hijack method when it fails, as it does if
+	// the connection was already hijacked. Handlers served over
+	// HTTP/2, which are not traced, cannot hijack at all; their
+	// ResponseWriter does not implement http.Hijacker.
+	HijackFailed func(error)
+
+	// HandlerDone is called after the handler has returned and
+	// the response has been flushed to the connection. If the
+	// handler panics, HandlerDone is called with the panic value,
+	// before the server closes the connection. It is not called
+	// for hijacked connections.
+	HandlerDone func(HandlerDoneInfo)
+
+	// CapturePanicStack causes the stack of a panicking handler
+	// to be reported in HandlerDoneInfo.PanicStack.
+	CapturePanicStack bool
+
+	// MeasurePeakHeap causes the growth of the heap while a
+	// request is served to be reported in
+	// HandlerDoneInfo.PeakHeapDelta. Measuring it briefly stops
+	// the world twice per request, so it is meant for
+	// investigating memory-hungry handlers rather than for
+	// production use.
+	MeasurePeakHeap bool
+
+	// ConnSummary is called once an HTTP/1.x connection has
+	// been closed, with totals for the requests served on it. It
+	// is not called for hijacked connections.
+	ConnSummary func(ConnSummaryInfo)
+
+	names  []string          // Names of t and the traces composed into it
+	stats  map[string]*int64 // Hook call counts, if CountHooks; shared by the installed copies of t
+	orig   *ServerTrace      // Trace t is an installed copy of, whose Enabled t follows
+	owners []*ServerTrace    // Traces composed into t, each of whose Enabled gates its hooks
+	output string            // TraceConfig.Output of NewTraceFromConfig
+}
+
+// Stats returns the number of times each of t's hooks has been
+// called since t was created, keyed by hook name, such as
+// "WroteHeader". The calls through all the copies of t installed with
+// WithServerTrace are counted, so Stats may be called on t itself or
+// on such a copy. Only the hooks set in t are included; hooks an
+// installed copy takes from the trace it was composed with are
+// counted by that trace, if at all. Stats returns nil if t's
+// CountHooks is not set. It is safe to call while the hooks are
+// being called.
+func (t *ServerTrace) Stats() map[string]int64 {
+	if t.orig != nil {
+		t = t.orig
+	}
+	if !t.CountHooks {
+		return nil
+	}
+	stats := t.counters()
+	m := make(map[string]int64, len(stats))
+	for name, n := range stats {
+		m[name] = atomic.LoadInt64(n)
+	}
+	return m
+}
+
+// statsMu guards the creation of ServerTrace.stats.
+var statsMu sync.Mutex
+
+// counters returns the counters of the calls of t's hooks, creating
+// them if needed. t must not be an installed copy.
+func (t *ServerTrace) counters() map[string]*int64 {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if t.stats == nil {
+		t.stats = make(map[string]*int64)
+		tv := reflect.ValueOf(t).Elem()
+		structType := tv.Type()
+		for i := 0; i < structType.NumField(); i++ {
+			if isHook(structType.Field(i)) && !tv.Field(i).IsNil() {
+				t.stats[structType.Field(i).Name] = new(int64)
+			}
+		}
+	}
+	return t.stats
+}
+
+// A ComposePolicy is the order in which a composed ServerTrace calls
+// its own hook and the previously registered hook it is composed with.
+type ComposePolicy int
+
+const (
+	// NewFirst calls the newly registered hook first. It is the
+	// default.
+	NewFirst ComposePolicy = iota
+
+	// OldFirst calls the previously registered hook first.
+	OldFirst
+)
+
+// A ComposeKind describes how WithServerTrace merged a hook of a
+// newly installed trace with that of the trace it is composed with.
+type ComposeKind int
+
+const (
+	// NewOnly means only the new trace set the hook.
+	NewOnly ComposeKind = iota
+
+	// OldOnly means only the previous trace set the hook, which
+	// the new trace inherits.
+	OldOnly
+
+	// Chained means both traces set the hook and the new trace
+	// calls both, in the order given by ComposeInfo.Policy.
+	Chained
+)
+
+// ComposeInfo is the argument to the ServerTrace.ComposeTrace
+// function.
+type ComposeInfo struct {
+	// Hook is the name of the hook, such as "WroteHeader".
+	Hook string
+
+	// Kind is how the hook was merged.
+	Kind ComposeKind
+
+	// Policy is the order in which a Chained hook calls the hooks
+	// of the two traces.
+	Policy ComposePolicy
+}
+
+// A HookCategory is a set of ServerTrace hooks. Categories may be
+// combined with bitwise OR.
+type HookCategory uint32
+
+const (
+	// ConnectionHooks are ServeStart, ServeShutdown,
+	// TLSHandshakeError, ProtocolNegotiated, SocketOptions,
+	// BufioPoolEvent, ConnectionReset, ConnectionLimited,
+	// RequestsPerConnLimitReached and ConnSummary.
+	ConnectionHooks HookCategory = 1 << iota
+
+	// RequestHooks are ReadFirstByte, GotMethod, GotRequest,
+	// EffectiveDeadline, GotQuery, GotCookie, GotTraceContext,
+	// TargetNormalized, GotAbsoluteURI, GotAuthScheme,
+	// GotServerOptions, GotContextKeys, PathCleaned and
+	// HandlerDone.
+	RequestHooks
+
+	// ResponseHooks are WroteHeader, CacheHeaders, Redirected,
+	// ProxyBackendDone, ConditionalResult, IfRangeEvaluated,
+	// MethodNotAllowed, DuplicateHeader, SniffedContentType,
+	// WroteDate, WroteServerHeader, AutoChunked,
+	// HeaderSanitized, NoContentLength and NegotiatedEncoding.
+	ResponseHooks
+
+	// BodyHooks are BodyReadStall, BodyReadComplete,
+	// GotRequestTrailers, BodyLimitExceeded, DecompressedRequest,
+	// GotRequestBodyType, WroteBodyChunk, WroteFinalChunk,
+	// ResponseTruncated, HeadBodyDiscarded, GotResponsePrefix,
+	// FrameRead, FrameWrite, ZeroCopyUsed and WriteBlocked.
+	BodyHooks
+
+	// ErrorHooks are SmugglingRejected, MethodRejected,
+	// StatusChangeAttempt, HandlerTimeout, PanicAfterCommit
+	// and HijackFailed.
+	ErrorHooks
+
+	AllHooks = ConnectionHooks | RequestHooks | ResponseHooks | BodyHooks | ErrorHooks
+)
+
+// hookCategories maps the name of each hook to its category.
+var hookCategories = map[string]HookCategory{
+	"ServeStart":                  ConnectionHooks,
+	"ServeShutdown":               ConnectionHooks,
+	"TLSHandshakeError":           ConnectionHooks,
+	"ProtocolNegotiated":          ConnectionHooks,
+	"SocketOptions":               ConnectionHooks,
+	"BufioPoolEvent":              ConnectionHooks,
+	"ConnectionReset":             ConnectionHooks,
+	"ConnectionLimited":           ConnectionHooks,
+	"RequestsPerConnLimitReached": ConnectionHooks,
+	"ConnSummary":                 ConnectionHooks,
+	"ReadFirstByte":               RequestHooks,
+	"GotMethod":                   RequestHooks,
+	"GotRequest":                  RequestHooks,
+	"EffectiveDeadline":           RequestHooks,
+	"GotQuery":                    RequestHooks,
+	"GotCookie":                   RequestHooks,
+	"GotTraceContext":             RequestHooks,
+	"TargetNormalized":            RequestHooks,
+	"GotAbsoluteURI":              RequestHooks,
+	"GotAuthScheme":               RequestHooks,
+	"GotServerOptions":            RequestHooks,
+	"GotContextKeys":              RequestHooks,
+	"PathCleaned":                 RequestHooks,
+	"HandlerDone":                 RequestHooks,
+	"WroteHeader":                 ResponseHooks,
+	"CacheHeaders":                ResponseHooks,
+	"Redirected":                  ResponseHooks,
+	"ProxyBackendDone":            ResponseHooks,
+	"ConditionalResult":           ResponseHooks,
+	"IfRangeEvaluated":            ResponseHooks,
+	"MethodNotAllowed":            ResponseHooks,
+	"DuplicateHeader":             ResponseHooks,
+	"SniffedContentType":          ResponseHooks,
+	"WroteDate":                   ResponseHooks,
+	"WroteServerHeader":           ResponseHooks,
+	"AutoChunked":                 ResponseHooks,
+	"HeaderSanitized":             ResponseHooks,
+	"NoContentLength":             ResponseHooks,
+	"NegotiatedEncoding":          ResponseHooks,
+	"BodyReadStall":               BodyHooks,
+	"BodyReadComplete":            BodyHooks,
+	"GotRequestTrailers":          BodyHooks,
+	"BodyLimitExceeded":           BodyHooks,
+	"DecompressedRequest":         BodyHooks,
+	"GotRequestBodyType":          BodyHooks,
+	"WroteBodyChunk":              BodyHooks,
+	"WroteFinalChunk":             BodyHooks,
+	"ResponseTruncated":           BodyHooks,
+	"HeadBodyDiscarded":           BodyHooks,
+	"GotResponsePrefix":           BodyHooks,
+	"FrameRead":                   BodyHooks,
+	"FrameWrite":                  BodyHooks,
+	"ZeroCopyUsed":                BodyHooks,
+	"WriteBlocked":                BodyHooks,
+	"SmugglingRejected":           ErrorHooks,
+	"MethodRejected":              ErrorHooks,
+	"StatusChangeAttempt":         ErrorHooks,
+	"HandlerTimeout":              ErrorHooks,
+	"PanicAfterCommit":            ErrorHooks,
+	"HijackFailed":                ErrorHooks,
+}
+
+// SetEnabled sets t.Enabled to c. Unlike assigning to t.Enabled
+// directly, it is safe to call while the server is calling t's hooks.
+// It applies to the copies of t installed with WithServerTrace, and
+// if t is such a copy, to the trace it was copied from.
+func (t *ServerTrace) SetEnabled(c HookCategory) {
+	if t.orig != nil {
+		t = t.orig
+	}
+	atomic.StoreUint32((*uint32)(&t.Enabled), uint32(c))
+}
+
+// IsEnabled reports whether t's hooks in any of the categories c
+// are enabled. If t was installed with WithServerTrace over other
+// traces, it reports whether those of any of the composed traces
+// are: each composed hook is called only if enabled by the Enabled
+// of the trace that set it.
+func (t *ServerTrace) IsEnabled(c HookCategory) bool {
+	if len(t.owners) == 0 {
+		return t.ownEnabled(c)
+	}
+	for _, o := range t.owners {
+		if o.ownEnabled(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownEnabled reports whether t's own Enabled, or that of the trace
+// it is a copy of, enables any of the categories c.
+func (t *ServerTrace) ownEnabled(c HookCategory) bool {
+	if t.orig != nil {
+		t = t.orig
+	}
+	e := HookCategory(atomic.LoadUint32((*uint32)(&t.Enabled)))
+	return e == 0 || e&c != 0
+}
+
+// RequestInfo is the argument to the ServerTrace.GotRequest function
+// and describes a request read by the server.
+type RequestInfo struct {
+	// ID identifies the request. It is unique among the requests
+	// served by the process and is the same in the information
+	// passed to every hook called for the request.
+	ID uint64
+
+	// Method is the request method.
+	Method string
+
+	// RequestURI is the unmodified request-target of the
+	// request line.
+	RequestURI string
+
+	// Proto is the protocol version, such as "HTTP/1.1".
+	Proto string
+
+	// Host is the host the request was sent to, from the Host
+	// header or the request-target.
+	Host string
+
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+
+	// ServerName is the server name the client requested via
+	// TLS Server Name Indication. It is empty for plaintext
+	// connections and for clients that do not send SNI.
+	ServerName string
+
+	// ChunkedRequestBody reports whether the request body is sent
+	// with the chunked Transfer-Encoding, in which case its
+	// length is not known in advance.
+	ChunkedRequestBody bool
+
+	// Deadline is the time by which the response must have been
+	// written, after which writes to the connection fail. It is
+	// set from http.Server.WriteTimeout, and is zero if there is
+	// no WriteTimeout.
+	Deadline time.Time
+
+	// CanonicalHeaders reports whether the server canonicalized
+	// the names of the request's header fields, as
+	// http.CanonicalHeaderKey does. HTTP/1.x requests have their
+	// header names canonicalized; HTTP/2 requests, which are not
+	// traced, have them lowercased.
+	CanonicalHeaders bool
+
+	// RawHeaderOrder lists the names of the request's header
+	// fields as the client sent them, in order and including
+	// repeated fields. It is only set if the trace's
+	// CaptureHeaderOrder is true.
+	RawHeaderOrder []string
+
+	// RawRequestLine is the request line exactly as the server
+	// read it, such as "GET /path HTTP/1.1", before the
+	// request-target is parsed and normalized, without its line
+	// ending. Long request lines are truncated to their first 4096
+	// bytes.
+	RawRequestLine string
+
+	// ConnContext is the context of the connection the request
+	// was read from, from which the request's context is derived.
+	// It is the same for all requests on a connection, so hooks
+	// may use it as a key for per-connection state. It is
+	// canceled when the connection is closed.
+	ConnContext context.Context
+
+	// Pipelined reports whether the client sent the request
+	// before the server had finished responding to the previous
+	// request on the connection, as HTTP/1.1 pipelining allows.
+	// The server still serves the requests one at a time, in
+	// order.
+	Pipelined bool
+}
+
+// DeadlineSourceInfo is the argument to the
+// ServerTrace.EffectiveDeadline function.
+type DeadlineSourceInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// Deadline is the earliest deadline that applies to the
+	// request.
+	Deadline time.Time
+
+	// Source is what set Deadline: "ReadTimeout" or
+	// "WriteTimeout" for the http.Server fields, or
+	// "TimeoutHandler".
+	Source string
+}
+
+// SmugglingInfo is the argument to the ServerTrace.SmugglingRejected
+// function.
+type SmugglingInfo struct {
+	// Reason describes the ambiguity that caused the request to
+	// be rejected. It is one of "multiple Content-Lengths",
+	// "unexpected Content-Length" (a Content-Length on a method
+	// without a body), "invalid Content-Length",
+	// "multiple Transfer-Encodings",
+	// "unsupported Transfer-Encoding" or "multiple Host headers".
+	Reason string
+
+	// DuplicateHost reports whether the request was rejected for
+	// having more than one Host header.
+	DuplicateHost bool
+
+	// Err is the error reading the request.
+	Err error
+}
+
+// BodyReadStallInfo is the argument to the ServerTrace.BodyReadStall
+// function.
+type BodyReadStallInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// BytesRead is the number of request body bytes read before
+	// the stalled Read began.
+	BytesRead int64
+}
+
+// WroteHeaderInfo is the argument to the ServerTrace.WroteHeader
+// function.
+type WroteHeaderInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// StatusCode is the response status code.
+	StatusCode int
+
+	// StatusText is the reason phrase the server sends in the
+	// status line, such as "Not Found". For status codes without
+	// a standard phrase, it is "status code" followed by the code.
+	StatusText string
+
+	// Header is the response header as set by the handler. It
+	// does not include headers the server adds automatically,
+	// such as Date. It must not be modified or retained.
+	Header map[string][]string
+}
+
+// ProxyInfo is the argument to the ServerTrace.ProxyBackendDone
+// function and describes a request a reverse proxy sent to its
+// backend.
+type ProxyInfo struct {
+	// Method and URL are the method and URL of the request sent
+	// to the backend. URL omits any user information, such as a
+	// password, from the request's URL.
+	Method string
+	URL    string
+
+	// StatusCode is the status code of the backend's response, or
+	// zero if Err is set.
+	StatusCode int
+
+	// Latency is the time from sending the request until the
+	// response header was received or the request failed.
+	Latency time.Duration
+
+	// Err is the error sending the request or reading the
+	// response header, if any.
+	Err error
+}
+
+// CacheInfo is the argument to the ServerTrace.CacheHeaders function.
+type CacheInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// CacheControl holds the directives of the Cache-Control
+	// header, keyed by lower-case directive name. Directives
+	// without an argument, such as "no-store", map to the empty
+	// string. Quoted arguments are unquoted.
+	CacheControl map[string]string
+
+	// ETag is the value of the ETag header, if any.
+	ETag string
+
+	// Vary lists the field names of the Vary header, if any.
+	Vary []string
+}
+
+// RedirectInfo is the argument to the ServerTrace.Redirected function.
+type RedirectInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// Location is the value of the response's Location header.
+	Location string
+
+	// StatusCode is the response status code, such as 301 or 307.
+	StatusCode int
+}
+
+// ConditionalInfo is the argument to the ServerTrace.ConditionalResult
+// function.
+type ConditionalInfo struct {
+	// Evaluated lists the precondition headers that were
+	// evaluated, in the order of evaluation. It may include
+	// "If-Match", "If-Unmodified-Since", "If-None-Match",
+	// "If-Modified-Since" and "If-Range".
+	Evaluated []string
+
+	// StatusCode is 304 (Not Modified) or 412 (Precondition
+	// Failed) if the preconditions cut the response short, or
+	// zero if the content is served.
+	StatusCode int
+}
+
+// NoContentLengthInfo is the argument to the
+// ServerTrace.NoContentLength function.
+type NoContentLengthInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// Method is the request method.
+	Method string
+
+	// StatusCode is the response status code.
+	StatusCode int
+
+	// Framing is how the end of the response body was signaled:
+	// "chunked" or "close".
+	Framing string
+}
+
+// WroteBodyChunkInfo is the argument to the ServerTrace.WroteBodyChunk
+// function.
+type WroteBodyChunkInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// Len is the number of bytes written.
+	Len int
+
+	// Err is any error returned by the Write.
+	Err error
+}
+
+// HandlerDoneInfo is the argument to the ServerTrace.HandlerDone
+// function.
+type HandlerDoneInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// StatusCode is the response status code.
+	StatusCode int
+
+	// StatusClass is the class of StatusCode, its first digit:
+	// 2 for success, 4 for client errors, 5 for server errors and
+	// so on.
+	StatusClass int
+
+	// BytesRead is the number of request body bytes read, by
+	// the handler or by the server on its behalf.
+	BytesRead int64
+
+	// BytesWritten is the number of response body bytes written
+	// by the handler.
+	BytesWritten int64
+
+	// WireBytesWritten is the number of bytes of the response the
+	// server wrote to the connection, including the status line,
+	// the header and the framing of a chunked body. Bytes the
+	// server had not yet written when HandlerDone was called, as
+	// when the handler panicked, are not included.
+	WireBytesWritten int64
+
+	// WriteCount is the number of non-empty Writes of the response
+	// body by the handler, and FlushCount the number of times it
+	// called the ResponseWriter's Flush method. Bodies copied with
+	// sendfile are not counted as Writes.
+	WriteCount int
+	FlushCount int
+
+	// KeepAliveHonored reports whether the server kept the
+	// connection open after an HTTP/1.0 request with a
+	// "Connection: keep-alive" header. It is false for other
+	// requests. The server closes the connection instead if, for
+	// example, the length of the response body is not known in
+	// advance.
+	KeepAliveHonored bool
+
+	// Duration is the time from the server reading the request
+	// headers until the response was flushed.
+	Duration time.Duration
+
+	// QueueWait is the part of Duration between the server
+	// finishing reading the request and calling the handler. It
+	// includes the time spent in hooks such as GotRequest. Time a
+	// middleware handler spends queueing the request is part of
+	// HandlerExecution, as the server cannot tell it apart.
+	QueueWait time.Duration
+
+	// HandlerExecution is the part of Duration from the server
+	// calling the handler until the response was flushed.
+	HandlerExecution time.Duration
+
+	// Panic is the value the handler panicked with, or nil if it
+	// returned normally.
+	Panic interface{}
+
+	// PanicStack is the formatted stack trace of the panicking
+	// handler's goroutine, as returned by runtime.Stack. It is
+	// only set if the trace's CapturePanicStack is true.
+	PanicStack []byte
+
+	// PeakHeapDelta is the number of bytes by which the heap
+	// grew between GotRequest and HandlerDone, as reported by
+	// runtime.MemStats.HeapAlloc. It is only an approximation of
+	// the request's memory high-water mark: it includes the
+	// allocations of concurrent requests and is reduced by
+	// garbage collections, so it may be negative. It is only set
+	// if the trace's MeasurePeakHeap is true.
+	PeakHeapDelta int64
+}
+
+// PanicInfo is the argument to the ServerTrace.PanicAfterCommit
+// function and describes a handler panic.
+type PanicInfo struct {
+	// ID identifies the request; see RequestInfo.ID.
+	ID uint64
+
+	// Value is the value the handler panicked with.
+	Value interface{}
+
+	// Stack is the formatted stack trace of the panicking
+	// handler's goroutine. It is only set if the trace's
+	// CapturePanicStack is true.
+	Stack []byte
+
+	// StatusCode is the status code of the committed response.
+	StatusCode int
+
+	// BytesWritten is the number of response body bytes the
+	// handler had written before it panicked, including any
+	// still buffered by the server.
+	BytesWritten int64
+}
+
+// SocketOptionsInfo is the argument to the ServerTrace.SocketOptions
+// function and describes the socket options of a TCP connection, as
+// read from the operating system.
+type SocketOptionsInfo struct {
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+
+	// NoDelay reports whether Nagle's algorithm is disabled,
+	// with TCP_NODELAY.
+	NoDelay bool
+
+	// KeepAlive reports whether TCP keep-alive probes are
+	// enabled, and KeepAliveInterval is the time between them.
+	KeepAlive         bool
+	KeepAliveInterval time.Duration
+
+	// ReadBuffer and WriteBuffer are the sizes in bytes of the
+	// socket's receive and send buffers.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// ConnSummaryInfo is the argument to the ServerTrace.ConnSummary
+// function. Its totals cover the requests on the connection that
+// were reported to HandlerDone.
+type ConnSummaryInfo struct {
+	// RemoteAddr is the network address of the client.
+	RemoteAddr string
+
+	// Requests is the number of requests served.
+	Requests int
+
+	// BytesRead is the total number of request body bytes read.
+	BytesRead int64
+
+	// BytesWritten is the total number of response body bytes
+	// written.
+	BytesWritten int64
+
+	// ErrorResponses is the number of responses with a 4xx or
+	// 5xx status code.
+	ErrorResponses int
+
+	// Duration is the time from the server starting to serve the
+	// connection until it was closed.
+	Duration time.Duration
+}
+
+// compose modifies t such that it respects the previously-registered hooks in old,
+// subject to the composition policy requested in t.Compose and t.ComposeOrder.
+// t's own hooks are wrapped, as described by wrapHooks, before they are
+// combined with old's, which old has wrapped itself. If old has no
+// OnHookPanic, t's also recovers panics in the hooks it takes from old.
+// Once composed, each hook checks the Enabled of the trace that set it.
+func (t *ServerTrace) compose(old *ServerTrace) {
+	t.names = nil
+	if t.Name != "" {
+		t.names = append(t.names, t.Name)
+	}
+	if old != nil {
+		t.names = append(t.names, old.names...)
+		t.inherit(old)
+	}
+	t.owners = []*ServerTrace{t}
+	if old != nil {
+		if len(old.owners) == 0 {
+			t.owners = append(t.owners, old)
+		}
+		t.owners = append(t.owners, old.owners...)
+	}
+	t.wrapHooks(old != nil)
+	if old == nil {
+		return
+	}
+	composed := func(hook string, kind ComposeKind, policy ComposePolicy) {
+		if t.ComposeTrace != nil {
+			t.ComposeTrace(ComposeInfo{Hook: hook, Kind: kind, Policy: policy})
+		}
+	}
+	var onPanic func(string, interface{})
+	if old.OnHookPanic == nil {
+		onPanic = t.OnHookPanic
+	}
+	tv := reflect.ValueOf(t).Elem()
+	structType := tv.Type()
+	ov := reflect.ValueOf(old).Elem()
+	for i := 0; i < structType.NumField(); i++ {
+		if !isHook(structType.Field(i)) {
+			continue
+		}
+		name := structType.Field(i).Name
+		tf := tv.Field(i)
+		hookType := tf.Type()
+		of := ov.Field(i)
+		if of.IsNil() {
+			if !tf.IsNil() {
+				composed(name, NewOnly, t.Compose)
+			}
+			continue
+		}
+		if len(old.owners) <= 1 {
+			// old's hooks were not composed, relying on
+			// the server to check its Enabled.
+			of = gateHook(name, reflect.ValueOf(of.Interface()), old)
+		}
+		if onPanic != nil {
+			of = recoverHook(name, reflect.ValueOf(of.Interface()), onPanic)
+		}
+		if tf.IsNil() {
+			tf.Set(of)
+			composed(name, OldOnly, t.Compose)
+			continue
+		}
+
+		// Make a copy of tf for tf to call. (Otherwise it
+		// creates a recursive call cycle and stack overflows)
+		tfCopy := reflect.ValueOf(tf.Interface())
+
+		policy := t.Compose
+		if p, ok := t.ComposeOrder[name]; ok {
+			policy = p
+		}
+		composed(name, Chained, policy)
+
+		// We need to call both tf and of in some order.
+		var newFunc reflect.Value
+		if policy == OldFirst {
+			newFunc = reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+				of.Call(args)
+				return tfCopy.Call(args)
+			})
+		} else {
+			newFunc = reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+				tfCopy.Call(args)
+				return of.Call(args)
+			})
+		}
+		tv.Field(i).Set(newFunc)
+	}
+}
+
+// inherit sets the fields of t that configure it, rather than hooks,
+// that are unset to those of old.
+func (t *ServerTrace) inherit(old *ServerTrace) {
+	if t.StallThreshold == 0 {
+		t.StallThreshold = old.StallThreshold
+	}
+	if t.WriteBlockThreshold == 0 {
+		t.WriteBlockThreshold = old.WriteBlockThreshold
+	}
+	if t.SingleValueHeaders == nil {
+		t.SingleValueHeaders = old.SingleValueHeaders
+	}
+	if t.ContextKeys == nil {
+		t.ContextKeys = old.ContextKeys
+	}
+	if t.MaxChunkHooks == 0 {
+		t.MaxChunkHooks = old.MaxChunkHooks
+	}
+	if t.CaptureResponseBody < old.CaptureResponseBody {
+		t.CaptureResponseBody = old.CaptureResponseBody
+	}
+	t.CapturePanicStack = t.CapturePanicStack || old.CapturePanicStack
+	t.CaptureHeaderOrder = t.CaptureHeaderOrder || old.CaptureHeaderOrder
+	t.MeasurePeakHeap = t.MeasurePeakHeap || old.MeasurePeakHeap
+	if t.OnHookPanic == nil {
+		t.OnHookPanic = old.OnHookPanic
+	}
+	if t.ComposeTrace == nil {
+		t.ComposeTrace = old.ComposeTrace
+	}
+	if t.SlowHook == nil {
+		t.SlowHook = old.SlowHook
+	}
+	if t.HookBudget == 0 {
+		t.HookBudget = old.HookBudget
+	}
+}
+
+// wrapHooks wraps each of t's hooks so that a panic in the hook is
+// recovered and reported to t.OnHookPanic, if set, a hook running
+// longer than t.HookBudget is reported to t.SlowHook, if set, calls
+// are counted if t.CountHooks is set, and, if t.Async is set, the
+// hook is called on a background goroutine. If gate is set, a hook
+// whose category t.Enabled disables is not called at all.
+func (t *ServerTrace) wrapHooks(gate bool) {
+	onPanic := t.OnHookPanic
+	slow, budget := t.SlowHook, t.HookBudget
+	if budget <= 0 {
+		slow = nil
+	}
+	var queue *hookQueue
+	if t.Async {
+		queue = newHookQueue(t.AsyncBuffer, t.AsyncFullPolicy)
+	}
+	var stats map[string]*int64
+	if t.CountHooks {
+		stats = t.stats
+	}
+	if !gate && onPanic == nil && slow == nil && queue == nil && stats == nil {
+		return
+	}
+	tv := reflect.ValueOf(t).Elem()
+	structType := tv.Type()
+	for i := 0; i < structType.NumField(); i++ {
+		if !isHook(structType.Field(i)) {
+			continue
+		}
+		f := tv.Field(i)
+		if f.IsNil() {
+			continue
+		}
+		name := structType.Field(i).Name
+		hookType := f.Type()
+		hook := reflect.ValueOf(f.Interface())
+		count := func() {}
+		if n := stats[name]; n != nil {
+			count = func() { atomic.AddInt64(n, 1) }
+		}
+		call := func(args []reflect.Value) (results []reflect.Value) {
+			if slow != nil {
+				t0 := time.Now()
+				defer func() {
+					if d := time.Since(t0); d > budget {
+						slow(name, d)
+					}
+				}()
+			}
+			if onPanic != nil {
+				defer func() {
+					if v := recover(); v != nil {
+						onPanic(name, v)
+						results = zeroResults(hookType)
+					}
+				}()
+			}
+			return hook.Call(args)
+		}
+		cat := hookCategories[name]
+		if queue != nil && hookType.NumOut() == 0 {
+			f.Set(reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+				if gate && !t.ownEnabled(cat) {
+					return nil
+				}
+				count()
+				args = copyArgs(args)
+				queue.add(func() { call(args) })
+				return nil
+			}))
+		} else {
+			f.Set(reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+				if gate && !t.ownEnabled(cat) {
+					return zeroResults(hookType)
+				}
+				count()
+				return call(args)
+			}))
+		}
+	}
+}
+
+// recoverHook returns a function that calls hook, recovering a panic
+// in it and reporting it to onPanic with the hook's name.
+func recoverHook(name string, hook reflect.Value, onPanic func(string, interface{})) reflect.Value {
+	hookType := hook.Type()
+	return reflect.MakeFunc(hookType, func(args []reflect.Value) (results []reflect.Value) {
+		defer func() {
+			if v := recover(); v != nil {
+				onPanic(name, v)
+				results = zeroResults(hookType)
+			}
+		}()
+		return hook.Call(args)
+	})
+}
+
+// gateHook returns a function that calls hook only if owner's Enabled
+// enables its category.
+func gateHook(name string, hook reflect.Value, owner *ServerTrace) reflect.Value {
+	hookType := hook.Type()
+	cat := hookCategories[name]
+	return reflect.MakeFunc(hookType, func(args []reflect.Value) []reflect.Value {
+		if !owner.ownEnabled(cat) {
+			return zeroResults(hookType)
+		}
+		return hook.Call(args)
+	})
+}
+
+// checkComposeOrder returns an error if a key of order is not the name
+// of a hook.
+func checkComposeOrder(order map[string]ComposePolicy) error {
+	for name := range order {
+		if hookCategories[name] == 0 {
+			return errors.New("httptrace: ComposeOrder has unknown hook " + strconv.Quote(name))
+		}
+	}
+	return nil
+}
+
+// isHook reports whether f is a ServerTrace hook: an exported field of
+// function type other than OnHookPanic, ComposeTrace and SlowHook.
+func isHook(f reflect.StructField) bool {
+	if f.Type.Kind() != reflect.Func || f.PkgPath != "" {
+		return false
+	}
+	return f.Name != "OnHookPanic" && f.Name != "ComposeTrace" && f.Name != "SlowHook"
+}
+
+// installed reports whether trace, or a trace with its non-empty
+// Name, has been composed into t.
+func (t *ServerTrace) installed(trace *ServerTrace) bool {
+	if t == nil {
+		return false
+	}
+	if trace.orig != nil {
+		trace = trace.orig
+	}
+	for _, o := range t.owners {
+		if o.orig == trace {
+			return true
+		}
+	}
+	if trace.Name == "" {
+		return false
+	}
+	for _, n := range t.names {
+		if n == trace.Name {
+			return true
+		}
+	}
+	return false
+}
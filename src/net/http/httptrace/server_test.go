@@ -0,0 +1,505 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWithServerTrace(t *testing.T) {
+	var buf bytes.Buffer
+	bodyReadStall := func(b byte) func(BodyReadStallInfo) {
+		return func(BodyReadStallInfo) {
+			buf.WriteByte(b)
+		}
+	}
+
+	ctx := context.Background()
+	oldtrace := &ServerTrace{
+		BodyReadStall:  bodyReadStall('O'),
+		StallThreshold: time.Second,
+	}
+	ctx = WithServerTrace(ctx, oldtrace)
+	newtrace := &ServerTrace{
+		BodyReadStall: bodyReadStall('N'),
+	}
+	ctx = WithServerTrace(ctx, newtrace)
+	trace := ContextServerTrace(ctx)
+
+	buf.Reset()
+	trace.BodyReadStall(BodyReadStallInfo{})
+	if got, want := buf.String(), "NO"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+	if got, want := trace.StallThreshold, time.Second; got != want {
+		t.Errorf("StallThreshold = %v; want %v", got, want)
+	}
+}
+
+func TestWithoutServerTrace(t *testing.T) {
+	var buf bytes.Buffer
+	ctx := WithServerTrace(context.Background(), &ServerTrace{
+		BodyReadStall: func(BodyReadStallInfo) {
+			buf.WriteByte('O')
+		},
+	})
+	detached := WithoutServerTrace(ctx)
+	if trace := ContextServerTrace(detached); trace != nil {
+		t.Fatalf("ContextServerTrace of detached context = %v; want nil", trace)
+	}
+	if ContextServerTrace(ctx) == nil {
+		t.Fatal("WithoutServerTrace detached the trace of its parent")
+	}
+
+	ctx = WithServerTrace(detached, &ServerTrace{
+		BodyReadStall: func(BodyReadStallInfo) {
+			buf.WriteByte('N')
+		},
+	})
+	ContextServerTrace(ctx).BodyReadStall(BodyReadStallInfo{})
+	if got, want := buf.String(), "N"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestWithServerTraceDeduplicates(t *testing.T) {
+	var calls int
+	shared := func(WroteHeaderInfo) {
+		calls++
+	}
+	trace := &ServerTrace{WroteHeader: shared}
+	ctx := WithServerTrace(context.Background(), trace)
+	ctx = WithServerTrace(ctx, &ServerTrace{OnHookPanic: func(string, interface{}) {}})
+	ctx = WithServerTrace(ctx, trace)
+	ContextServerTrace(ctx).WroteHeader(WroteHeaderInfo{})
+	if calls != 1 {
+		t.Errorf("WroteHeader of trace installed twice called %d times; want 1", calls)
+	}
+
+	// Installing an installed copy of trace is also a no-op.
+	calls = 0
+	ctx = WithServerTrace(ctx, ContextServerTrace(ctx))
+	ContextServerTrace(ctx).WroteHeader(WroteHeaderInfo{})
+	if calls != 1 {
+		t.Errorf("WroteHeader after installing a copy called %d times; want 1", calls)
+	}
+
+	// Distinct traces sharing a hook each call it.
+	calls = 0
+	ctx = WithServerTrace(context.Background(), &ServerTrace{WroteHeader: shared})
+	ctx = WithServerTrace(ctx, &ServerTrace{WroteHeader: shared})
+	ContextServerTrace(ctx).WroteHeader(WroteHeaderInfo{})
+	if calls != 2 {
+		t.Errorf("WroteHeader shared by two traces called %d times; want 2", calls)
+	}
+}
+
+func TestWithServerTraceNamed(t *testing.T) {
+	var buf bytes.Buffer
+	newLogTrace := func() *ServerTrace {
+		return &ServerTrace{
+			Name: "log",
+			BodyReadStall: func(BodyReadStallInfo) {
+				buf.WriteByte('L')
+			},
+		}
+	}
+	other := &ServerTrace{
+		BodyReadStall: func(BodyReadStallInfo) {
+			buf.WriteByte('X')
+		},
+	}
+
+	ctx := context.Background()
+	ctx = WithServerTrace(ctx, newLogTrace())
+	ctx = WithServerTrace(ctx, other)
+	ctx = WithServerTrace(ctx, newLogTrace())
+	trace := ContextServerTrace(ctx)
+	trace.BodyReadStall(BodyReadStallInfo{})
+	if got, want := buf.String(), "XL"; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// Installing the very same trace twice is also a no-op.
+	buf.Reset()
+	lt := newLogTrace()
+	ctx = WithServerTrace(context.Background(), lt)
+	ctx = WithServerTrace(ctx, lt)
+	ContextServerTrace(ctx).BodyReadStall(BodyReadStallInfo{})
+	if got, want := buf.String(), "L"; got != want {
+		t.Errorf("same trace: got %q; want %q", got, want)
+	}
+}
+
+func TestServerTraceIsEnabled(t *testing.T) {
+	trace := new(ServerTrace)
+	if !trace.IsEnabled(BodyHooks) {
+		t.Error("zero Enabled: BodyHooks disabled")
+	}
+	trace.SetEnabled(RequestHooks | ResponseHooks)
+	if trace.IsEnabled(BodyHooks) {
+		t.Error("BodyHooks enabled")
+	}
+	if !trace.IsEnabled(ResponseHooks) {
+		t.Error("ResponseHooks disabled")
+	}
+	if !trace.IsEnabled(BodyHooks | RequestHooks) {
+		t.Error("IsEnabled(BodyHooks|RequestHooks) = false; want true")
+	}
+}
+
+func TestServerTraceIsEnabledComposed(t *testing.T) {
+	var calls []string
+	hook := func(name string) func(WroteHeaderInfo) {
+		return func(WroteHeaderInfo) { calls = append(calls, name) }
+	}
+	chunk := func(name string) func(WroteBodyChunkInfo) {
+		return func(WroteBodyChunkInfo) { calls = append(calls, name) }
+	}
+	server := &ServerTrace{
+		Enabled:        AllHooks &^ BodyHooks,
+		WroteHeader:    hook("server"),
+		WroteBodyChunk: chunk("server"),
+	}
+	handler := &ServerTrace{
+		Enabled:        RequestHooks | BodyHooks,
+		WroteHeader:    hook("handler"),
+		WroteBodyChunk: chunk("handler"),
+	}
+	ctx := WithServerTrace(context.Background(), server)
+	ctx = WithServerTrace(ctx, handler)
+	trace := ContextServerTrace(ctx)
+
+	for _, c := range []HookCategory{ResponseHooks, BodyHooks, RequestHooks, ErrorHooks} {
+		if !trace.IsEnabled(c) {
+			t.Errorf("IsEnabled(%v) = false; want true", c)
+		}
+	}
+
+	trace.WroteHeader(WroteHeaderInfo{})
+	trace.WroteBodyChunk(WroteBodyChunkInfo{})
+	if want := []string{"server", "handler"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q; want %q", calls, want)
+	}
+
+	calls = nil
+	server.SetEnabled(BodyHooks)
+	handler.SetEnabled(ResponseHooks)
+	trace.WroteHeader(WroteHeaderInfo{})
+	trace.WroteBodyChunk(WroteBodyChunkInfo{})
+	if want := []string{"handler", "server"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("after SetEnabled: calls = %q; want %q", calls, want)
+	}
+	if trace.IsEnabled(ErrorHooks) {
+		t.Errorf("after SetEnabled: IsEnabled(ErrorHooks) = true; want false")
+	}
+}
+
+func TestHookCategories(t *testing.T) {
+	structType := reflect.TypeOf(ServerTrace{})
+	for i := 0; i < structType.NumField(); i++ {
+		f := structType.Field(i)
+		if isHook(f) && hookCategories[f.Name] == 0 {
+			t.Errorf("hook %s has no category", f.Name)
+		}
+	}
+}
+
+func TestServerTraceComposeOrder(t *testing.T) {
+	var buf bytes.Buffer
+	gotRequest := func(b byte) func(RequestInfo) {
+		return func(RequestInfo) {
+			buf.WriteByte(b)
+		}
+	}
+	wroteHeader := func(b byte) func(WroteHeaderInfo) {
+		return func(WroteHeaderInfo) {
+			buf.WriteByte(b)
+		}
+	}
+
+	tests := []struct {
+		trace           *ServerTrace
+		wantGotRequest  string
+		wantWroteHeader string
+	}{
+		{
+			trace:           &ServerTrace{},
+			wantGotRequest:  "NO",
+			wantWroteHeader: "NO",
+		},
+		{
+			trace:           &ServerTrace{Compose: OldFirst},
+			wantGotRequest:  "ON",
+			wantWroteHeader: "ON",
+		},
+		{
+			trace: &ServerTrace{
+				ComposeOrder: map[string]ComposePolicy{"WroteHeader": OldFirst},
+			},
+			wantGotRequest:  "NO",
+			wantWroteHeader: "ON",
+		},
+		{
+			trace: &ServerTrace{
+				Compose:      OldFirst,
+				ComposeOrder: map[string]ComposePolicy{"WroteHeader": NewFirst},
+			},
+			wantGotRequest:  "ON",
+			wantWroteHeader: "NO",
+		},
+	}
+	for i, tt := range tests {
+		old := &ServerTrace{
+			GotRequest:  gotRequest('O'),
+			WroteHeader: wroteHeader('O'),
+		}
+		tr := tt.trace
+		tr.GotRequest = gotRequest('N')
+		tr.WroteHeader = wroteHeader('N')
+		tr.compose(old)
+
+		buf.Reset()
+		tr.GotRequest(RequestInfo{})
+		if got := buf.String(); got != tt.wantGotRequest {
+			t.Errorf("%d. GotRequest order = %q; want %q", i, got, tt.wantGotRequest)
+		}
+		buf.Reset()
+		tr.WroteHeader(WroteHeaderInfo{})
+		if got := buf.String(); got != tt.wantWroteHeader {
+			t.Errorf("%d. WroteHeader order = %q; want %q", i, got, tt.wantWroteHeader)
+		}
+	}
+}
+
+func TestServerTraceComposeOrderUnknown(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("WithServerTrace with an unknown ComposeOrder hook did not panic")
+		}
+	}()
+	WithServerTrace(context.Background(), &ServerTrace{
+		ComposeOrder: map[string]ComposePolicy{"WroteHeaders": OldFirst},
+	})
+}
+
+func TestServerTraceOnHookPanic(t *testing.T) {
+	var called bool
+	var gotHook string
+	var gotValue interface{}
+	metrics := &ServerTrace{
+		Name: "metrics",
+		WroteHeader: func(WroteHeaderInfo) {
+			panic("boom")
+		},
+	}
+	logTrace := &ServerTrace{
+		WroteHeader: func(WroteHeaderInfo) {
+			called = true
+		},
+		OnHookPanic: func(hook string, v interface{}) {
+			gotHook, gotValue = hook, v
+		},
+	}
+	ctx := WithServerTrace(context.Background(), metrics)
+	ctx = WithServerTrace(ctx, logTrace)
+	ContextServerTrace(ctx).WroteHeader(WroteHeaderInfo{})
+	if !called {
+		t.Error("WroteHeader of the non-panicking trace not called")
+	}
+	if gotHook != "WroteHeader" || gotValue != "boom" {
+		t.Errorf("OnHookPanic(%q, %v); want (%q, %v)", gotHook, gotValue, "WroteHeader", "boom")
+	}
+}
+
+func TestServerTraceSlowHook(t *testing.T) {
+	const budget = 10 * time.Millisecond
+	var slow []string
+	trace := &ServerTrace{
+		GotRequest: func(RequestInfo) {
+			time.Sleep(5 * budget)
+		},
+		WroteHeader: func(WroteHeaderInfo) {},
+		SlowHook: func(hook string, d time.Duration) {
+			if d < budget {
+				t.Errorf("SlowHook(%q, %v) for a hook within the budget", hook, d)
+			}
+			slow = append(slow, hook)
+		},
+		HookBudget: budget,
+	}
+	ctx := WithServerTrace(context.Background(), trace)
+	trace = ContextServerTrace(ctx)
+	trace.GotRequest(RequestInfo{})
+	trace.WroteHeader(WroteHeaderInfo{})
+	if want := []string{"GotRequest"}; !reflect.DeepEqual(slow, want) {
+		t.Errorf("SlowHook calls = %q; want %q", slow, want)
+	}
+}
+
+func TestServerTraceSlowHookComposed(t *testing.T) {
+	const budget = 10 * time.Millisecond
+	var slow []string
+	ctx := WithServerTrace(context.Background(), &ServerTrace{
+		GotRequest: func(RequestInfo) {
+			time.Sleep(5 * budget)
+		},
+		SlowHook: func(hook string, d time.Duration) {
+			slow = append(slow, hook)
+		},
+		HookBudget: budget,
+	})
+	ctx = WithServerTrace(ctx, &ServerTrace{
+		WroteHeader: func(WroteHeaderInfo) {
+			time.Sleep(5 * budget)
+		},
+	})
+	trace := ContextServerTrace(ctx)
+	trace.GotRequest(RequestInfo{})
+	trace.WroteHeader(WroteHeaderInfo{})
+	if want := []string{"GotRequest", "WroteHeader"}; !reflect.DeepEqual(slow, want) {
+		t.Errorf("SlowHook calls = %q; want %q", slow, want)
+	}
+}
+
+func TestServerTraceAsync(t *testing.T) {
+	release := make(chan bool)
+	got := make(chan string, 2)
+	trace := &ServerTrace{
+		GotRequest: func(RequestInfo) {
+			<-release
+			got <- "GotRequest"
+		},
+		WroteHeader: func(WroteHeaderInfo) {
+			got <- "WroteHeader"
+		},
+		Async: true,
+	}
+	trace = ContextServerTrace(WithServerTrace(context.Background(), trace))
+	returned := make(chan bool)
+	go func() {
+		trace.GotRequest(RequestInfo{})
+		trace.WroteHeader(WroteHeaderInfo{})
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook calls blocked on a slow hook")
+	}
+	close(release)
+	for _, want := range []string{"GotRequest", "WroteHeader"} {
+		select {
+		case hook := <-got:
+			if hook != want {
+				t.Errorf("called %s; want %s", hook, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not called", want)
+		}
+	}
+}
+
+func TestServerTraceAsyncDropWhenFull(t *testing.T) {
+	started := make(chan bool)
+	release := make(chan bool)
+	var calls int
+	done := make(chan bool)
+	trace := &ServerTrace{
+		GotMethod: func(method string) {
+			calls++
+			if method == "first" {
+				started <- true
+				<-release
+			}
+			if method == "last" {
+				close(done)
+			}
+		},
+		Async:           true,
+		AsyncBuffer:     1,
+		AsyncFullPolicy: DropWhenFull,
+	}
+	trace = ContextServerTrace(WithServerTrace(context.Background(), trace))
+	trace.GotMethod("first")
+	<-started
+	trace.GotMethod("last")
+	trace.GotMethod("dropped")
+	trace.GotMethod("dropped")
+	close(release)
+	<-done
+	if calls != 2 {
+		t.Errorf("GotMethod called %d times; want 2", calls)
+	}
+}
+
+func TestServerTraceStats(t *testing.T) {
+	trace := &ServerTrace{
+		GotMethod:   func(string) {},
+		WroteHeader: func(WroteHeaderInfo) {},
+		CountHooks:  true,
+	}
+	want := map[string]int64{"GotMethod": 0, "WroteHeader": 0}
+	if stats := trace.Stats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats before install = %v; want %v", stats, want)
+	}
+	// Calls through each installed copy of trace are counted,
+	// including concurrent installs as TraceHandler does.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ContextServerTrace(WithServerTrace(context.Background(), trace)).GotMethod("GET")
+		}()
+	}
+	wg.Wait()
+	installed := ContextServerTrace(WithServerTrace(context.Background(), trace))
+	installed.WroteHeader(WroteHeaderInfo{})
+	want = map[string]int64{"GotMethod": 3, "WroteHeader": 1}
+	if stats := trace.Stats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats() = %v; want %v", stats, want)
+	}
+	if stats := installed.Stats(); !reflect.DeepEqual(stats, want) {
+		t.Errorf("Stats() of installed copy = %v; want %v", stats, want)
+	}
+
+	uncounted := ContextServerTrace(WithServerTrace(context.Background(), &ServerTrace{GotMethod: func(string) {}}))
+	uncounted.GotMethod("GET")
+	if stats := uncounted.Stats(); stats != nil {
+		t.Errorf("Stats() without CountHooks = %v; want nil", stats)
+	}
+}
+
+func TestServerTraceComposeTrace(t *testing.T) {
+	var got []ComposeInfo
+	oldtrace := &ServerTrace{
+		GotRequest:  func(RequestInfo) {},
+		WroteHeader: func(WroteHeaderInfo) {},
+	}
+	newtrace := &ServerTrace{
+		WroteHeader:  func(WroteHeaderInfo) {},
+		HandlerDone:  func(HandlerDoneInfo) {},
+		ComposeOrder: map[string]ComposePolicy{"WroteHeader": OldFirst},
+		ComposeTrace: func(info ComposeInfo) {
+			got = append(got, info)
+		},
+	}
+	ctx := WithServerTrace(context.Background(), oldtrace)
+	WithServerTrace(ctx, newtrace)
+	want := []ComposeInfo{
+		{Hook: "GotRequest", Kind: OldOnly},
+		{Hook: "WroteHeader", Kind: Chained, Policy: OldFirst},
+		{Hook: "HandlerDone", Kind: NewOnly},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ComposeTrace calls = %+v; want %+v", got, want)
+	}
+}
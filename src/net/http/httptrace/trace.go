@@ -3,7 +3,7 @@
 // license that can be found in the LICENSE file.
 
 // Package httptrace provides mechanisms to trace the events within
-// HTTP client requests.
+// HTTP client requests and within the requests served by an HTTP server.
 package httptrace
 
 import (
@@ -0,0 +1,161 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+var errFrameLength = errors.New("httptrace: WebSocket frame length has its most significant bit set")
+
+// FrameInfo is the argument to the ServerTrace.FrameRead and
+// FrameWrite functions and describes a WebSocket frame, as defined by
+// RFC 6455.
+type FrameInfo struct {
+	// Opcode is the frame's opcode, such as 0x1 for a text frame
+	// or 0x8 for a close frame.
+	Opcode byte
+
+	// Fin reports whether the frame is the final fragment of its
+	// message.
+	Fin bool
+
+	// Masked reports whether the frame's payload is masked, as
+	// frames sent by clients must be.
+	Masked bool
+
+	// Len is the length of the frame's payload in bytes.
+	Len int64
+}
+
+// NewWebSocketConn returns a net.Conn that reads from and writes to c,
+// a connection hijacked from the server on which the WebSocket
+// protocol has been established. It calls the FrameRead and
+// FrameWrite hooks of trace as the header of each WebSocket frame is
+// read from or written to c. If trace is nil or has neither hook, c
+// is returned unchanged.
+//
+// The returned conn only observes the frames; it does not otherwise
+// validate them. The exception is a 64-bit payload length with its
+// most significant bit set, which RFC 6455 forbids and which would
+// leave the conn unable to find the next frame: no hook is called for
+// such a frame, and the Read or Write that sees it, and any after it,
+// return an error. The conn must be used for all reads and writes of
+// the WebSocket stream, starting at a frame boundary.
+func NewWebSocketConn(c net.Conn, trace *ServerTrace) net.Conn {
+	if trace == nil || trace.FrameRead == nil && trace.FrameWrite == nil {
+		return c
+	}
+	fc := &frameConn{Conn: c}
+	fc.r.hook = trace.FrameRead
+	fc.w.hook = trace.FrameWrite
+	fc.r.trace = trace
+	fc.w.trace = trace
+	return fc
+}
+
+type frameConn struct {
+	net.Conn
+	r, w frameParser
+}
+
+func (c *frameConn) Read(p []byte) (int, error) {
+	if c.r.err != nil {
+		return 0, c.r.err
+	}
+	n, err := c.Conn.Read(p)
+	c.r.feed(p[:n])
+	if c.r.err != nil {
+		err = c.r.err
+	}
+	return n, err
+}
+
+func (c *frameConn) Write(p []byte) (int, error) {
+	if c.w.err != nil {
+		return 0, c.w.err
+	}
+	n, err := c.Conn.Write(p)
+	c.w.feed(p[:n])
+	if c.w.err != nil {
+		err = c.w.err
+	}
+	return n, err
+}
+
+// A frameParser follows a stream of WebSocket frames, calling hook
+// with the header of each.
+type frameParser struct {
+	trace  *ServerTrace
+	hook   func(FrameInfo)
+	hdr    [14]byte // header of the current frame, up to n
+	n      int
+	remain int64 // payload bytes of the current frame not yet seen
+	err    error // protocol error that stopped the parser, if any
+}
+
+// headerLen returns the length of the current frame's header, or 2 if
+// too little of it has been seen to tell.
+func (p *frameParser) headerLen() int {
+	if p.n < 2 {
+		return 2
+	}
+	size := 2
+	switch p.hdr[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if p.hdr[1]&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+func (p *frameParser) feed(b []byte) {
+	for len(b) > 0 && p.err == nil {
+		if p.remain > 0 {
+			k := int64(len(b))
+			if k > p.remain {
+				k = p.remain
+			}
+			b = b[k:]
+			p.remain -= k
+			continue
+		}
+		p.hdr[p.n] = b[0]
+		p.n++
+		b = b[1:]
+		if p.n < p.headerLen() {
+			continue
+		}
+		info := FrameInfo{
+			Opcode: p.hdr[0] & 0x0f,
+			Fin:    p.hdr[0]&0x80 != 0,
+			Masked: p.hdr[1]&0x80 != 0,
+		}
+		switch l := p.hdr[1] & 0x7f; l {
+		case 126:
+			info.Len = int64(binary.BigEndian.Uint16(p.hdr[2:4]))
+		case 127:
+			n := binary.BigEndian.Uint64(p.hdr[2:10])
+			if n >= 1<<63 {
+				p.err = errFrameLength
+				return
+			}
+			info.Len = int64(n)
+		default:
+			info.Len = int64(l)
+		}
+		p.n = 0
+		p.remain = info.Len
+		if p.hook != nil && p.trace.IsEnabled(BodyHooks) {
+			p.hook(info)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httptrace_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	. "net/http/httptrace"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// wsFrame returns a WebSocket frame with the given opcode and payload,
+// masked with a zero key if masked is set.
+func wsFrame(opcode byte, payload string, masked bool) []byte {
+	b := []byte{0x80 | opcode}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		b = append(b, maskBit|byte(n))
+	default:
+		b = append(b, maskBit|126, byte(n>>8), byte(n))
+	}
+	if masked {
+		b = append(b, 0, 0, 0, 0)
+	}
+	return append(b, payload...)
+}
+
+func TestWebSocketConn(t *testing.T) {
+	var (
+		mu            sync.Mutex
+		read, written []FrameInfo
+	)
+	done := make(chan bool)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		ws := NewWebSocketConn(c, ContextServerTrace(r.Context()))
+		if brw.Reader.Buffered() > 0 {
+			t.Error("unexpected buffered data")
+			return
+		}
+
+		// Echo frames, unmasked, until the close frame.
+		br := bufio.NewReader(ws)
+		for {
+			var hdr [2]byte
+			if _, err := io.ReadFull(br, hdr[:]); err != nil {
+				t.Error(err)
+				return
+			}
+			n := int(hdr[1] & 0x7f)
+			if n == 126 {
+				var ext [2]byte
+				io.ReadFull(br, ext[:])
+				n = int(ext[0])<<8 | int(ext[1])
+			}
+			io.ReadFull(br, make([]byte, 4)) // zero mask key
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(br, payload); err != nil {
+				t.Error(err)
+				return
+			}
+			opcode := hdr[0] & 0x0f
+			ws.Write(wsFrame(opcode, string(payload), false))
+			if opcode == 0x8 {
+				return
+			}
+		}
+	}))
+	ts.Config.Trace = &ServerTrace{
+		FrameRead: func(info FrameInfo) {
+			mu.Lock()
+			read = append(read, info)
+			mu.Unlock()
+		},
+		FrameWrite: func(info FrameInfo) {
+			mu.Lock()
+			written = append(written, info)
+			mu.Unlock()
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: foo\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d; want 101", res.StatusCode)
+	}
+	long := strings.Repeat("x", 300)
+	// Write the frames a byte at a time to exercise the parser's
+	// handling of headers split across reads.
+	for _, b := range wsFrame(0x1, "hello", true) {
+		c.Write([]byte{b})
+	}
+	c.Write(append(wsFrame(0x2, long, true), wsFrame(0x8, "", true)...))
+	<-done
+	io.Copy(ioutil.Discard, br)
+
+	mu.Lock()
+	defer mu.Unlock()
+	wantRead := []FrameInfo{
+		{Opcode: 0x1, Fin: true, Masked: true, Len: 5},
+		{Opcode: 0x2, Fin: true, Masked: true, Len: 300},
+		{Opcode: 0x8, Fin: true, Masked: true, Len: 0},
+	}
+	if !reflect.DeepEqual(read, wantRead) {
+		t.Errorf("FrameRead calls = %+v; want %+v", read, wantRead)
+	}
+	wantWritten := []FrameInfo{
+		{Opcode: 0x1, Fin: true, Len: 5},
+		{Opcode: 0x2, Fin: true, Len: 300},
+		{Opcode: 0x8, Fin: true, Len: 0},
+	}
+	if !reflect.DeepEqual(written, wantWritten) {
+		t.Errorf("FrameWrite calls = %+v; want %+v", written, wantWritten)
+	}
+}
+
+func TestWebSocketConnLengthTooLarge(t *testing.T) {
+	var read []FrameInfo
+	trace := &ServerTrace{
+		FrameRead: func(info FrameInfo) { read = append(read, info) },
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	ws := NewWebSocketConn(server, trace)
+	defer ws.Close()
+
+	frame := []byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0}
+	go client.Write(frame)
+	buf := make([]byte, 64)
+	var err error
+	for n := 0; n < len(frame) && err == nil; {
+		var k int
+		k, err = ws.Read(buf)
+		n += k
+	}
+	if err == nil {
+		t.Fatal("Read of a frame with a length of 1<<63 + 5 succeeded")
+	}
+	if _, err := ws.Read(buf); err == nil {
+		t.Error("Read after a protocol error succeeded")
+	}
+	if len(read) != 0 {
+		t.Errorf("FrameRead calls = %+v; want none", read)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httputil
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// maxJSONTraceRequests is the number of requests a trace returned by
+// NewJSONTrace follows at once. Requests that never reach HandlerDone,
+// such as those whose connection is hijacked, would otherwise be kept
+// forever.
+const maxJSONTraceRequests = 4096
+
+// NewJSONTrace returns a ServerTrace that records the events of each
+// request and, once the request's handler is done, writes a single
+// JSON object describing the request to w, followed by a newline.
+// The object holds the request's metadata, its response status, byte
+// counts and duration, and an "events" array listing the traced
+// events in the order they occurred.
+//
+// The objects of concurrent requests are written with separate calls
+// to w.Write and are never interleaved. Events of requests that do not
+// run to completion, such as those on hijacked connections, are not
+// written. The trace follows a bounded number of requests at once; if
+// that many are in progress, it forgets the oldest to follow a new
+// one.
+func NewJSONTrace(w io.Writer) *httptrace.ServerTrace {
+	jt := &jsonTrace{
+		w:    w,
+		reqs: make(map[uint64]*jsonRequest),
+	}
+	return &httptrace.ServerTrace{
+		GotRequest:     jt.gotRequest,
+		BodyReadStall:  jt.bodyReadStall,
+		WroteHeader:    jt.wroteHeader,
+		WroteBodyChunk: jt.wroteBodyChunk,
+		HandlerDone:    jt.handlerDone,
+	}
+}
+
+type jsonTrace struct {
+	w io.Writer
+
+	mu    sync.Mutex // guards reqs, order and calls to w.Write
+	reqs  map[uint64]*jsonRequest
+	order []uint64 // IDs added to reqs, oldest first; may include removed ones
+}
+
+// jsonRequest is the JSON document written for each request.
+type jsonRequest struct {
+	ID           uint64        `json:"id"`
+	Method       string        `json:"method"`
+	RequestURI   string        `json:"requestURI"`
+	Proto        string        `json:"proto"`
+	Host         string        `json:"host"`
+	RemoteAddr   string        `json:"remoteAddr"`
+	ServerName   string        `json:"serverName,omitempty"`
+	StatusCode   int           `json:"status"`
+	BytesRead    int64         `json:"bytesRead"`
+	BytesWritten int64         `json:"bytesWritten"`
+	Duration     time.Duration `json:"duration"`
+	Events       []jsonEvent   `json:"events"`
+
+	start time.Time
+}
+
+// jsonEvent is a single traced event of a jsonRequest. Elapsed is the
+// time since the request's GotRequest event.
+type jsonEvent struct {
+	Event     string        `json:"event"`
+	Elapsed   time.Duration `json:"elapsed"`
+	Status    int           `json:"status,omitempty"`
+	Len       int           `json:"len,omitempty"`
+	BytesRead int64         `json:"bytesRead,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// addEvent appends ev to the events of request id, if it is known.
+func (jt *jsonTrace) addEvent(id uint64, ev jsonEvent) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	if r := jt.reqs[id]; r != nil {
+		ev.Elapsed = time.Since(r.start)
+		r.Events = append(r.Events, ev)
+	}
+}
+
+func (jt *jsonTrace) gotRequest(info httptrace.RequestInfo) {
+	r := &jsonRequest{
+		ID:         info.ID,
+		Method:     info.Method,
+		RequestURI: info.RequestURI,
+		Proto:      info.Proto,
+		Host:       info.Host,
+		RemoteAddr: info.RemoteAddr,
+		ServerName: info.ServerName,
+		Events:     []jsonEvent{{Event: "GotRequest"}},
+		start:      time.Now(),
+	}
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	for len(jt.reqs) >= maxJSONTraceRequests {
+		delete(jt.reqs, jt.order[0])
+		jt.order = jt.order[1:]
+	}
+	if len(jt.order) >= 2*maxJSONTraceRequests {
+		// Drop the IDs of requests that are done.
+		order := make([]uint64, 0, len(jt.reqs))
+		for _, id := range jt.order {
+			if jt.reqs[id] != nil {
+				order = append(order, id)
+			}
+		}
+		jt.order = order
+	}
+	jt.reqs[info.ID] = r
+	jt.order = append(jt.order, info.ID)
+}
+
+func (jt *jsonTrace) bodyReadStall(info httptrace.BodyReadStallInfo) {
+	jt.addEvent(info.ID, jsonEvent{Event: "BodyReadStall", BytesRead: info.BytesRead})
+}
+
+func (jt *jsonTrace) wroteHeader(info httptrace.WroteHeaderInfo) {
+	jt.addEvent(info.ID, jsonEvent{Event: "WroteHeader", Status: info.StatusCode})
+}
+
+func (jt *jsonTrace) wroteBodyChunk(info httptrace.WroteBodyChunkInfo) {
+	ev := jsonEvent{Event: "WroteBodyChunk", Len: info.Len}
+	if info.Err != nil {
+		ev.Error = info.Err.Error()
+	}
+	jt.addEvent(info.ID, ev)
+}
+
+func (jt *jsonTrace) handlerDone(info httptrace.HandlerDoneInfo) {
+	jt.mu.Lock()
+	r := jt.reqs[info.ID]
+	delete(jt.reqs, info.ID)
+	jt.mu.Unlock()
+	if r == nil {
+		return
+	}
+	r.StatusCode = info.StatusCode
+	r.BytesRead = info.BytesRead
+	r.BytesWritten = info.BytesWritten
+	r.Duration = info.Duration
+	r.Events = append(r.Events, jsonEvent{Event: "HandlerDone", Elapsed: time.Since(r.start)})
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return
+	}
+	b = append(b, '\n')
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	jt.w.Write(b)
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package httputil
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	. "net/http/httptrace"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type jsonTestRequest struct {
+	ID           uint64
+	Method       string
+	RequestURI   string
+	StatusCode   int `json:"status"`
+	BytesWritten int64
+	Events       []struct {
+		Event string
+		Len   int
+	}
+}
+
+func (r *jsonTestRequest) eventNames() []string {
+	var names []string
+	for _, ev := range r.Events {
+		names = append(names, ev.Event)
+	}
+	return names
+}
+
+func TestJSONTrace(t *testing.T) {
+	var buf bytes.Buffer
+	trace := NewJSONTrace(&buf)
+	trace.GotRequest(RequestInfo{ID: 7, Method: "GET", RequestURI: "/foo"})
+	trace.WroteHeader(WroteHeaderInfo{ID: 7, StatusCode: 404})
+	trace.WroteBodyChunk(WroteBodyChunkInfo{ID: 7, Len: 3})
+	trace.WroteBodyChunk(WroteBodyChunkInfo{ID: 7, Len: 4})
+	if buf.Len() != 0 {
+		t.Fatalf("wrote %q before HandlerDone", buf.Bytes())
+	}
+	trace.HandlerDone(HandlerDoneInfo{ID: 7, StatusCode: 404, BytesWritten: 7})
+
+	var r jsonTestRequest
+	if err := json.Unmarshal(buf.Bytes(), &r); err != nil {
+		t.Fatalf("Unmarshal(%q): %v", buf.Bytes(), err)
+	}
+	if r.ID != 7 || r.Method != "GET" || r.RequestURI != "/foo" || r.StatusCode != 404 || r.BytesWritten != 7 {
+		t.Errorf("got request %+v", r)
+	}
+	want := []string{"GotRequest", "WroteHeader", "WroteBodyChunk", "WroteBodyChunk", "HandlerDone"}
+	if got := r.eventNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %q; want %q", got, want)
+	}
+	if r.Events[2].Len != 3 || r.Events[3].Len != 4 {
+		t.Errorf("chunk lengths = %d, %d; want 3, 4", r.Events[2].Len, r.Events[3].Len)
+	}
+}
+
+func TestJSONTraceConcurrent(t *testing.T) {
+	var buf bytes.Buffer
+	trace := NewJSONTrace(&buf)
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 1; i <= n; i++ {
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			trace.GotRequest(RequestInfo{ID: id})
+			trace.WroteHeader(WroteHeaderInfo{ID: id, StatusCode: 200})
+			for j := 0; j < 10; j++ {
+				trace.WroteBodyChunk(WroteBodyChunkInfo{ID: id, Len: 1})
+			}
+			trace.HandlerDone(HandlerDoneInfo{ID: id, StatusCode: 200})
+		}(uint64(i))
+	}
+	wg.Wait()
+
+	seen := make(map[uint64]bool)
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		var r jsonTestRequest
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("Unmarshal(%q): %v", sc.Bytes(), err)
+		}
+		if len(r.Events) != 13 {
+			t.Errorf("request %d has %d events; want 13", r.ID, len(r.Events))
+		}
+		seen[r.ID] = true
+	}
+	if len(seen) != n {
+		t.Errorf("saw %d requests; want %d", len(seen), n)
+	}
+}
+
+func TestJSONTraceForgetsUnfinished(t *testing.T) {
+	var buf bytes.Buffer
+	trace := NewJSONTrace(&buf)
+	// Requests 1 and 2 never finish, as if their connections had
+	// been hijacked.
+	for id := uint64(1); id <= maxJSONTraceRequests+10; id++ {
+		trace.GotRequest(RequestInfo{ID: id})
+		if id > 2 {
+			trace.HandlerDone(HandlerDoneInfo{ID: id})
+		}
+	}
+	for id := uint64(maxJSONTraceRequests + 11); id <= 2*maxJSONTraceRequests+20; id++ {
+		trace.GotRequest(RequestInfo{ID: id})
+	}
+	trace.HandlerDone(HandlerDoneInfo{ID: 1})
+	trace.HandlerDone(HandlerDoneInfo{ID: 2*maxJSONTraceRequests + 20})
+	sc := bufio.NewScanner(&buf)
+	n := 0
+	for sc.Scan() {
+		var r jsonTestRequest
+		if err := json.Unmarshal(sc.Bytes(), &r); err != nil {
+			t.Fatalf("Unmarshal(%q): %v", sc.Bytes(), err)
+		}
+		if r.ID == 1 {
+			t.Error("wrote request 1, which should have been forgotten")
+		}
+		n++
+	}
+	if want := maxJSONTraceRequests + 8 + 1; n != want {
+		t.Errorf("wrote %d requests; want %d", n, want)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
 	"sync"
@@ -198,7 +199,23 @@ func (p *ReverseProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		outreq.Header.Set("X-Forwarded-For", clientIP)
 	}
 
+	start := time.Now()
 	res, err := transport.RoundTrip(outreq)
+	if trace := httptrace.ContextServerTrace(req.Context()); trace != nil && trace.ProxyBackendDone != nil && trace.IsEnabled(httptrace.ResponseHooks) {
+		// Keep any credentials in the URL out of the trace.
+		u := *outreq.URL
+		u.User = nil
+		info := httptrace.ProxyInfo{
+			Method:  outreq.Method,
+			URL:     u.String(),
+			Latency: time.Since(start),
+			Err:     err,
+		}
+		if res != nil {
+			info.StatusCode = res.StatusCode
+		}
+		trace.ProxyBackendDone(info)
+	}
 	if err != nil {
 		p.logf("http: proxy error: %v", err)
 		rw.WriteHeader(http.StatusBadGateway)
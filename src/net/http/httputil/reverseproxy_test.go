@@ -16,6 +16,7 @@ import (
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
 	"net/url"
 	"reflect"
 	"strconv"
@@ -764,6 +765,63 @@ func TestClonesRequestHeaders(t *testing.T) {
 
 }
 
+func TestReverseProxyServerTrace(t *testing.T) {
+	const delay = 10 * time.Millisecond
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []httptrace.ProxyInfo
+	trace := &httptrace.ServerTrace{
+		ProxyBackendDone: func(info httptrace.ProxyInfo) {
+			got = append(got, info)
+		},
+	}
+	serve := func(rp *ReverseProxy) {
+		req, _ := http.NewRequest("GET", "http://foo.tld/path", nil)
+		req = req.WithContext(httptrace.WithServerTrace(req.Context(), trace))
+		rp.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve(NewSingleHostReverseProxy(backendURL))
+	serve(&ReverseProxy{
+		Director: func(*http.Request) {},
+		Transport: roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			return nil, io.EOF
+		}),
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	})
+	serve(&ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.User = url.UserPassword("user", "secret")
+		},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL.User == nil {
+				t.Error("proxied request lost its user information")
+			}
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+		}),
+	})
+
+	if len(got) != 3 {
+		t.Fatalf("ProxyBackendDone called %d times; want 3", len(got))
+	}
+	if info := got[0]; info.Method != "GET" || info.URL != backend.URL+"/path" || info.StatusCode != http.StatusTeapot || info.Latency < delay || info.Err != nil {
+		t.Errorf("ProxyBackendDone(%+v) for the backend's response", info)
+	}
+	if info := got[1]; info.StatusCode != 0 || info.Err != io.EOF {
+		t.Errorf("ProxyBackendDone(%+v) for a failed request; want Err %v", info, io.EOF)
+	}
+	if info := got[2]; info.URL != "http://foo.tld/path" {
+		t.Errorf("ProxyBackendDone URL = %q; want %q, without user information", info.URL, "http://foo.tld/path")
+	}
+}
+
 type roundTripperFunc func(req *http.Request) (*http.Response, error)
 
 func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
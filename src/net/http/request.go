@@ -900,6 +900,46 @@ func newTextprotoReader(br *bufio.Reader) *textproto.Reader {
 	return textproto.NewReader(br)
 }
 
+// A headerRecorder records the bytes of a request's request line and
+// header as they are read from r, one byte per Read.
+type headerRecorder struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+func (hr *headerRecorder) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c, err := hr.r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	hr.buf = append(hr.buf, c)
+	p[0] = c
+	return 1, nil
+}
+
+// names returns the names of the header fields recorded by hr, in
+// order.
+func (hr *headerRecorder) names() []string {
+	var names []string
+	lines := bytes.Split(hr.buf, []byte("\n"))
+	for _, line := range lines[1:] { // skip the request line
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue // continuation of the previous field
+		}
+		if i := bytes.IndexByte(line, ':'); i > 0 {
+			names = append(names, string(line[:i]))
+		}
+	}
+	return names
+}
+
 func putTextprotoReader(r *textproto.Reader) {
 	r.R = nil
 	textprotoReaderPool.Put(r)
@@ -907,7 +947,7 @@ func putTextprotoReader(r *textproto.Reader) {
 
 // ReadRequest reads and parses an incoming request from b.
 func ReadRequest(b *bufio.Reader) (*Request, error) {
-	return readRequest(b, deleteHostHeader)
+	return readRequest(b, deleteHostHeader, nil)
 }
 
 // Constants for readRequest's deleteHostHeader parameter.
@@ -916,8 +956,38 @@ const (
 	keepHostHeader   = false
 )
 
-func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err error) {
+// rawRequest records parts of a request as the client sent them,
+// before they are parsed, for tracing.
+type rawRequest struct {
+	// captureHeaderOrder is whether readRequest sets headerOrder.
+	captureHeaderOrder bool
+
+	// line is the request line, truncated to maxRawRequestLine
+	// bytes.
+	line string
+
+	// headerOrder lists the names of the request's header fields,
+	// as sent and in order.
+	headerOrder []string
+}
+
+// maxRawRequestLine is the most bytes of a request line recorded in
+// a rawRequest.
+const maxRawRequestLine = 4 << 10
+
+// readRequest reads a request from b. If raw is non-nil, readRequest
+// records the request line, and the header order if requested, in
+// raw.
+func readRequest(b *bufio.Reader, deleteHostHeader bool, raw *rawRequest) (req *Request, err error) {
+	var hr *headerRecorder
 	tp := newTextprotoReader(b)
+	if raw != nil && raw.captureHeaderOrder {
+		// Read the request line and header through a recorder that
+		// reads b one byte at a time, so that no bytes beyond the
+		// header are buffered away from b.
+		hr = &headerRecorder{r: b}
+		tp.R = bufio.NewReaderSize(hr, 16)
+	}
 	req = new(Request)
 
 	// First line: GET /index.html HTTP/1.0
@@ -925,6 +995,12 @@ func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err erro
 	if s, err = tp.ReadLine(); err != nil {
 		return nil, err
 	}
+	if raw != nil {
+		raw.line = s
+		if len(raw.line) > maxRawRequestLine {
+			raw.line = raw.line[:maxRawRequestLine]
+		}
+	}
 	defer func() {
 		putTextprotoReader(tp)
 		if err == io.EOF {
@@ -974,6 +1050,9 @@ func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err erro
 		return nil, err
 	}
 	req.Header = Header(mimeHeader)
+	if hr != nil {
+		raw.headerOrder = hr.names()
+	}
 
 	// RFC 2616: Must treat
 	//	GET /index.html HTTP/1.1
@@ -1020,15 +1099,20 @@ func readRequest(b *bufio.Reader, deleteHostHeader bool) (req *Request, err erro
 //
 // MaxBytesReader prevents clients from accidentally or maliciously
 // sending a large request and wasting server resources.
+//
+// If w is the ResponseWriter passed to the handler by the server,
+// exceeding the limit calls the BodyLimitExceeded hook of the
+// server's ServerTrace, if any.
 func MaxBytesReader(w ResponseWriter, r io.ReadCloser, n int64) io.ReadCloser {
-	return &maxBytesReader{w: w, r: r, n: n}
+	return &maxBytesReader{w: w, r: r, n: n, limit: n}
 }
 
 type maxBytesReader struct {
-	w   ResponseWriter
-	r   io.ReadCloser // underlying reader
-	n   int64         // max bytes remaining
-	err error         // sticky error
+	w     ResponseWriter
+	r     io.ReadCloser // underlying reader
+	n     int64         // max bytes remaining
+	limit int64         // original value of n
+	err   error         // sticky error
 }
 
 func (l *maxBytesReader) Read(p []byte) (n int, err error) {
@@ -1068,6 +1152,12 @@ func (l *maxBytesReader) Read(p []byte) (n int, err error) {
 	if res, ok := l.w.(requestTooLarger); ok {
 		res.requestTooLarge()
 	}
+	type bodyLimitTracer interface {
+		traceBodyLimitExceeded(limit int64)
+	}
+	if res, ok := l.w.(bodyLimitTracer); ok {
+		res.traceBodyLimitExceeded(l.limit)
+	}
 	l.err = errors.New("http: request body too large")
 	return n, l.err
 }
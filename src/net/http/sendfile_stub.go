@@ -0,0 +1,12 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !dragonfly,!freebsd,!linux,!solaris,!windows
+
+package http
+
+// sendfileSupported reports whether the ReadFrom method of a
+// *net.TCPConn copies from regular files in the kernel. On this
+// system it copies them in user space.
+const sendfileSupported = false
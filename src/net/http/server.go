@@ -17,11 +17,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http/httptrace"
 	"net/textproto"
 	"net/url"
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -227,9 +229,19 @@ type conn struct {
 	// Immutable; never nil.
 	server *Server
 
-	// cancelCtx cancels the connection-level context.
+	// trace is the server trace, if any, found in the
+	// connection's context. It is set at the start of serve.
+	trace *httptrace.ServerTrace
+
+	// ctx is the connection-level context, and cancelCtx cancels
+	// it. They are set in serve before requests are read.
+	ctx       context.Context
 	cancelCtx context.CancelFunc
 
+	// pipelined reports whether bytes of the next request had
+	// been received when the server finished the previous one.
+	pipelined bool
+
 	// rwc is the underlying network connection.
 	// This is never wrapped by other types and is the value given out
 	// to CloseNotifier callers. It is usually of type *net.TCPConn or
@@ -250,6 +262,24 @@ type conn struct {
 	// It is set via checkConnErrorWriter{w}, where bufw writes.
 	werr error
 
+	// wireBytes is the number of bytes written to rwc via
+	// checkConnErrorWriter or sendfile.
+	wireBytes int64
+
+	// resetTraced is set to 1 once the trace's ConnectionReset
+	// hook has been called for the connection. Accessed atomically.
+	resetTraced int32
+
+	// start is when serve began serving the connection, and
+	// summary accumulates the information for the trace's
+	// ConnSummary hook. Both are only set if trace is non-nil.
+	start   time.Time
+	summary httptrace.ConnSummaryInfo
+
+	// requests is the number of requests read on the connection.
+	// It is only counted if the server's MaxRequestsPerConn is set.
+	requests int
+
 	// r is bufr's read source. It's a wrapper around rwc that provides
 	// io.LimitedReader-style limiting (while reading request headers)
 	// and functionality to support CloseNotifier. See *connReader docs.
@@ -334,7 +364,11 @@ type chunkWriter struct {
 	wroteHeader bool
 
 	// set by the writeHeader method:
-	chunking bool // using chunked transfer encoding for reply body
+	chunking     bool // using chunked transfer encoding for reply body
+	closeFraming bool // reply body ends when the connection is closed
+
+	discarded int64 // body bytes eaten because the request was HEAD
+	trailers  bool  // close wrote trailers after the final chunk
 }
 
 var (
@@ -348,6 +382,7 @@ func (cw *chunkWriter) Write(p []byte) (n int, err error) {
 	}
 	if cw.res.req.Method == "HEAD" {
 		// Eat writes.
+		cw.discarded += int64(len(p))
 		return len(p), nil
 	}
 	if cw.chunking {
@@ -384,6 +419,7 @@ func (cw *chunkWriter) close() {
 		bw.WriteString("0\r\n")
 		if trailers := cw.res.finalTrailers(); trailers != nil {
 			trailers.Write(bw) // the writer handles noting errors
+			cw.trailers = true
 		}
 		// final blank line after the trailers (whether
 		// present or not)
@@ -449,6 +485,69 @@ type response struct {
 	// non-nil. Make this lazily-created again as it used to be?
 	closeNotifyCh  chan bool
 	didCloseNotify int32 // atomic (only 0->1 winner should send)
+
+	// traceID identifies the request to the connection's
+	// httptrace.ServerTrace, if any. traceStart is when the
+	// server began reading the request.
+	traceID    uint64
+	traceStart time.Time
+
+	// trace is the trace whose hooks are called for the request
+	// from the time its handler is called: the connection's, or
+	// one installed for the request by TraceHandler.
+	trace *httptrace.ServerTrace
+
+	// writeDeadline is the write deadline set on the connection
+	// for the response, or zero if none.
+	writeDeadline time.Time
+
+	// pipelined reports whether the request was received before
+	// the response to the previous request was finished.
+	pipelined bool
+
+	// readDeadline is the read deadline set on the connection for
+	// the request body, and handlerDeadline the earliest deadline
+	// of any TimeoutHandlers serving the request, or zero if none.
+	readDeadline    time.Time
+	handlerDeadline time.Time
+
+	// rawRequestLine is the request line as sent, truncated, and
+	// headerOrder lists the request's header names as sent, if
+	// the connection's trace captures them.
+	rawRequestLine string
+	headerOrder    []string
+
+	// truncated reports whether a write of the body to the
+	// connection failed, and truncatedAt how many body bytes had
+	// been written when it first did.
+	truncated   bool
+	truncatedAt int64
+
+	// bodyPrefix holds the start of the response body, if the
+	// connection's trace captures it.
+	bodyPrefix []byte
+
+	// chunkHooks counts the calls of the WroteBodyChunk trace hook,
+	// which stop at the trace's MaxChunkHooks.
+	chunkHooks int
+
+	// writes and flushes count the handler's non-empty Writes and
+	// its Flushes, for the HandlerDone trace hook.
+	writes, flushes int
+
+	// traceRead is when the server finished reading the request,
+	// and handlerStart when it called the handler. They are only
+	// set if the connection has a trace.
+	traceRead    time.Time
+	handlerStart time.Time
+
+	// heapStart is the heap size when the server finished reading
+	// the request, if the connection's trace measures it.
+	heapStart uint64
+
+	// wireStart is the connection's wireBytes when the server
+	// finished reading the request.
+	wireStart int64
 }
 
 // TrailerPrefix is a magic prefix for ResponseWriter.Header map keys
@@ -516,6 +615,14 @@ func (w *response) requestTooLarge() {
 	}
 }
 
+// traceBodyLimitExceeded calls the trace's BodyLimitExceeded hook
+// when a MaxBytesReader wrapping w's request body exceeds its limit.
+func (w *response) traceBodyLimitExceeded(limit int64) {
+	if trace := traceHooks(w.trace, httptrace.BodyHooks); trace != nil && trace.BodyLimitExceeded != nil {
+		trace.BodyLimitExceeded(limit)
+	}
+}
+
 // needsSniff reports whether a Content-Type still needs to be sniffed.
 func (w *response) needsSniff() bool {
 	_, haveType := w.handlerHeader["Content-Type"]
@@ -555,6 +662,7 @@ func (w *response) ReadFrom(src io.Reader) (n int64, err error) {
 		return 0, err
 	}
 	if !ok || !regFile {
+		w.traceZeroCopy(false)
 		bufp := copyBufPool.Get().(*[]byte)
 		defer copyBufPool.Put(bufp)
 		return io.CopyBuffer(writerOnly{w}, src, *bufp)
@@ -579,17 +687,28 @@ func (w *response) ReadFrom(src io.Reader) (n int64, err error) {
 
 	// Now that cw has been flushed, its chunking field is guaranteed initialized.
 	if !w.cw.chunking && w.bodyAllowed() {
+		w.traceZeroCopy(sendfileSupported)
 		n0, err := rf.ReadFrom(src)
 		n += n0
 		w.written += n0
+		w.conn.wireBytes += n0
 		return n, err
 	}
 
+	w.traceZeroCopy(false)
 	n0, err := io.Copy(writerOnly{w}, src)
 	n += n0
 	return n, err
 }
 
+// traceZeroCopy calls the ZeroCopyUsed trace hook, if any, with
+// whether ReadFrom copies the response body in the kernel.
+func (w *response) traceZeroCopy(used bool) {
+	if trace := traceHooks(w.trace, httptrace.BodyHooks); trace != nil && trace.ZeroCopyUsed != nil {
+		trace.ZeroCopyUsed(used)
+	}
+}
+
 // debugServerConnections controls whether all server connections are wrapped
 // with a verbose logging wrapper.
 const debugServerConnections = false
@@ -694,6 +813,7 @@ func (cr *connReader) hitReadLimit() bool        { return cr.remain <= 0 }
 
 // may be called from multiple goroutines.
 func (cr *connReader) handleReadError(err error) {
+	cr.conn.traceReset(err)
 	cr.conn.cancelCtx()
 	cr.closeNotify()
 }
@@ -783,12 +903,17 @@ func bufioWriterPool(size int) *sync.Pool {
 	return nil
 }
 
-func newBufioReader(r io.Reader) *bufio.Reader {
+// newBufioReader returns a bufio.Reader reading from r, reusing one
+// from bufioReaderPool if possible. The BufioPoolEvent hook of trace,
+// if any, is told whether it was reused.
+func newBufioReader(r io.Reader, trace *httptrace.ServerTrace) *bufio.Reader {
 	if v := bufioReaderPool.Get(); v != nil {
 		br := v.(*bufio.Reader)
 		br.Reset(r)
+		traceBufioPool(trace, "reader", true)
 		return br
 	}
+	traceBufioPool(trace, "reader", false)
 	// Note: if this reader size is ever changed, update
 	// TestHandlerBodyClose's assumptions.
 	return bufio.NewReader(r)
@@ -799,18 +924,29 @@ func putBufioReader(br *bufio.Reader) {
 	bufioReaderPool.Put(br)
 }
 
-func newBufioWriterSize(w io.Writer, size int) *bufio.Writer {
+// newBufioWriterSize returns a bufio.Writer of the given size writing
+// to w, reusing one from the pool for that size if possible. The
+// BufioPoolEvent hook of trace, if any, is told whether it was reused.
+func newBufioWriterSize(w io.Writer, size int, trace *httptrace.ServerTrace) *bufio.Writer {
 	pool := bufioWriterPool(size)
 	if pool != nil {
 		if v := pool.Get(); v != nil {
 			bw := v.(*bufio.Writer)
 			bw.Reset(w)
+			traceBufioPool(trace, "writer", true)
 			return bw
 		}
 	}
+	traceBufioPool(trace, "writer", false)
 	return bufio.NewWriterSize(w, size)
 }
 
+func traceBufioPool(trace *httptrace.ServerTrace, kind string, reused bool) {
+	if trace := traceHooks(trace, httptrace.ConnectionHooks); trace != nil && trace.BufioPoolEvent != nil {
+		trace.BufioPoolEvent(kind, reused)
+	}
+}
+
 func putBufioWriter(bw *bufio.Writer) {
 	bw.Reset(nil)
 	if pool := bufioWriterPool(bw.Available()); pool != nil {
@@ -896,6 +1032,10 @@ func appendTime(b []byte, t time.Time) []byte {
 
 var errTooLarge = errors.New("http: request too large")
 
+// lastTraceID is the most recently assigned httptrace request ID.
+// It is accessed atomically.
+var lastTraceID uint64
+
 // Read next request from connection.
 func (c *conn) readRequest(ctx context.Context) (w *response, err error) {
 	if c.hijacked() {
@@ -916,23 +1056,44 @@ func (c *conn) readRequest(ctx context.Context) (w *response, err error) {
 	c.rwc.SetReadDeadline(hdrDeadline)
 	if d := c.server.WriteTimeout; d != 0 {
 		defer func() {
-			c.rwc.SetWriteDeadline(time.Now().Add(d))
+			deadline := time.Now().Add(d)
+			c.rwc.SetWriteDeadline(deadline)
+			if w != nil {
+				w.writeDeadline = deadline
+			}
 		}()
 	}
 
 	c.r.setReadLimit(c.server.initialReadLimitSize())
+	if trace := traceHooks(c.trace, httptrace.RequestHooks); trace != nil && trace.ReadFirstByte != nil {
+		if _, err := c.bufr.Peek(1); err == nil {
+			trace.ReadFirstByte(time.Now())
+		}
+	}
 	if c.lastMethod == "POST" {
 		// RFC 2616 section 4.1 tolerance for old buggy clients.
 		peek, _ := c.bufr.Peek(4) // ReadRequest will get err below
 		c.bufr.Discard(numLeadingCRorLF(peek))
 	}
-	req, err := readRequest(c.bufr, keepHostHeader)
+	var raw *rawRequest
+	if trace := traceHooks(c.trace, httptrace.RequestHooks); trace != nil {
+		raw = &rawRequest{captureHeaderOrder: trace.CaptureHeaderOrder}
+	}
+	req, err := readRequest(c.bufr, keepHostHeader, raw)
 	if err != nil {
 		if c.r.hitReadLimit() {
 			return nil, errTooLarge
 		}
+		if bse, ok := err.(*badStringError); ok && bse.what == "invalid method" {
+			if trace := traceHooks(c.trace, httptrace.ErrorHooks); trace != nil && trace.MethodRejected != nil {
+				trace.MethodRejected(bse.str, StatusBadRequest)
+			}
+		}
 		return nil, err
 	}
+	if trace := traceHooks(c.trace, httptrace.RequestHooks); trace != nil && trace.GotMethod != nil {
+		trace.GotMethod(req.Method)
+	}
 
 	if !http1ServerSupportsRequest(req) {
 		return nil, badRequestError("unsupported protocol version")
@@ -947,7 +1108,7 @@ func (c *conn) readRequest(ctx context.Context) (w *response, err error) {
 		return nil, badRequestError("missing required Host header")
 	}
 	if len(hosts) > 1 {
-		return nil, badRequestError("too many Host headers")
+		return nil, &framingError{"multiple Host headers", badRequestError("too many Host headers")}
 	}
 	if len(hosts) == 1 && !httplex.ValidHostHeader(hosts[0]) {
 		return nil, badRequestError("malformed Host header")
@@ -968,8 +1129,34 @@ func (c *conn) readRequest(ctx context.Context) (w *response, err error) {
 	req.ctx = ctx
 	req.RemoteAddr = c.remoteAddr
 	req.TLS = c.tlsState
+	var traceID uint64
+	if c.trace != nil {
+		traceID = atomic.AddUint64(&lastTraceID, 1)
+	}
 	if body, ok := req.Body.(*body); ok {
 		body.doEarlyClose = true
+		if trace := c.trace; trace != nil && trace.BodyReadStall != nil && trace.StallThreshold > 0 {
+			body.stallThreshold = trace.StallThreshold
+			body.onReadStall = func(n int64) {
+				if trace.IsEnabled(httptrace.BodyHooks) {
+					trace.BodyReadStall(httptrace.BodyReadStallInfo{ID: traceID, BytesRead: n})
+				}
+			}
+		}
+		if trace := c.trace; trace != nil && trace.BodyReadComplete != nil {
+			body.onReadDone = func(clean bool, n int64) {
+				if trace.IsEnabled(httptrace.BodyHooks) {
+					trace.BodyReadComplete(clean, n)
+				}
+			}
+		}
+		if trace := c.trace; trace != nil && trace.GotRequestTrailers != nil {
+			body.onTrailer = func(trailer Header) {
+				if trace.IsEnabled(httptrace.BodyHooks) {
+					trace.GotRequestTrailers(trailer)
+				}
+			}
+		}
 	}
 
 	// Adjust the read deadline if necessary.
@@ -991,15 +1178,266 @@ func (c *conn) readRequest(ctx context.Context) (w *response, err error) {
 		// and maybe mutates it (Issue 14940)
 		wants10KeepAlive: req.wantsHttp10KeepAlive(),
 		wantsClose:       req.wantsClose(),
+
+		traceID:      traceID,
+		traceStart:   t0,
+		trace:        c.trace,
+		readDeadline: wholeReqDeadline,
+		pipelined:    c.pipelined,
+		wireStart:    c.wireBytes,
+	}
+	if raw != nil {
+		w.rawRequestLine = raw.line
+		w.headerOrder = raw.headerOrder
 	}
 	if isH2Upgrade {
 		w.closeAfterReply = true
 	}
 	w.cw.res = w
-	w.w = newBufioWriterSize(&w.cw, bufferBeforeChunkingSize)
+	w.w = newBufioWriterSize(&w.cw, bufferBeforeChunkingSize, c.trace)
 	return w, nil
 }
 
+// traceHooks returns trace if it is non-nil and its hooks in
+// category cat are enabled. Otherwise it returns nil.
+func traceHooks(trace *httptrace.ServerTrace, cat httptrace.HookCategory) *httptrace.ServerTrace {
+	if trace == nil || !trace.IsEnabled(cat) {
+		return nil
+	}
+	return trace
+}
+
+// traceReset calls the trace's ConnectionReset hook if err shows
+// that the peer reset the connection. The hook is called at most once
+// per connection. It may be called from multiple goroutines.
+func (c *conn) traceReset(err error) {
+	trace := traceHooks(c.trace, httptrace.ConnectionHooks)
+	if trace == nil || trace.ConnectionReset == nil || !isConnResetError(err) {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&c.resetTraced, 0, 1) {
+		trace.ConnectionReset()
+	}
+}
+
+// requestInfo returns the trace information for w's request.
+func (w *response) requestInfo() httptrace.RequestInfo {
+	req := w.req
+	info := httptrace.RequestInfo{
+		ID:         w.traceID,
+		Method:     req.Method,
+		RequestURI: req.RequestURI,
+		Proto:      req.Proto,
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+
+		ChunkedRequestBody: chunked(req.TransferEncoding),
+		Deadline:           w.writeDeadline,
+		CanonicalHeaders:   true,
+		RawHeaderOrder:     w.headerOrder,
+		RawRequestLine:     w.rawRequestLine,
+		ConnContext:        w.conn.ctx,
+		Pipelined:          w.pipelined,
+	}
+	if req.TLS != nil {
+		info.ServerName = req.TLS.ServerName
+	}
+	return info
+}
+
+// effectiveDeadline returns the earliest of the deadlines that apply
+// to w's request and its source, or a zero time if none do.
+func (w *response) effectiveDeadline() (d time.Time, source string) {
+	for _, c := range []struct {
+		d      time.Time
+		source string
+	}{
+		{w.readDeadline, "ReadTimeout"},
+		{w.writeDeadline, "WriteTimeout"},
+		{w.handlerDeadline, "TimeoutHandler"},
+	} {
+		if !c.d.IsZero() && (d.IsZero() || c.d.Before(d)) {
+			d, source = c.d, c.source
+		}
+	}
+	return d, source
+}
+
+// traceHandlerDeadline records deadline, the time limit of a
+// TimeoutHandler serving w's request, and calls the trace's
+// EffectiveDeadline hook, if any, if it is earlier than the deadlines
+// already in effect.
+func (w *response) traceHandlerDeadline(deadline time.Time) {
+	if d, _ := w.effectiveDeadline(); !d.IsZero() && !deadline.Before(d) {
+		return
+	}
+	w.handlerDeadline = deadline
+	if trace := traceHooks(w.trace, httptrace.RequestHooks); trace != nil && trace.EffectiveDeadline != nil {
+		trace.EffectiveDeadline(httptrace.DeadlineSourceInfo{ID: w.traceID, Deadline: deadline, Source: "TimeoutHandler"})
+	}
+}
+
+// cacheInfo returns the caching-related trace information for w's
+// response header.
+func (w *response) cacheInfo() httptrace.CacheInfo {
+	h := w.handlerHeader
+	info := httptrace.CacheInfo{
+		ID:   w.traceID,
+		ETag: h.get("Etag"),
+	}
+	for _, v := range h["Cache-Control"] {
+		foreachHeaderElement(v, func(d string) {
+			name, arg := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				name, arg = textproto.TrimString(d[:i]), textproto.TrimString(d[i+1:])
+				if len(arg) >= 2 && arg[0] == '"' && arg[len(arg)-1] == '"' {
+					arg = arg[1 : len(arg)-1]
+				}
+			}
+			if info.CacheControl == nil {
+				info.CacheControl = make(map[string]string)
+			}
+			info.CacheControl[strings.ToLower(name)] = arg
+		})
+	}
+	for _, v := range h["Vary"] {
+		foreachHeaderElement(v, func(f string) {
+			info.Vary = append(info.Vary, f)
+		})
+	}
+	return info
+}
+
+// handlerDoneInfo returns the trace information for w's
+// finished response.
+func (w *response) handlerDoneInfo() httptrace.HandlerDoneInfo {
+	now := time.Now()
+	info := httptrace.HandlerDoneInfo{
+		ID:               w.traceID,
+		StatusCode:       w.status,
+		StatusClass:      w.status / 100,
+		BytesWritten:     w.written,
+		WireBytesWritten: w.conn.wireBytes - w.wireStart,
+		WriteCount:       w.writes,
+		FlushCount:       w.flushes,
+		Duration:         now.Sub(w.traceStart),
+		QueueWait:        w.handlerStart.Sub(w.traceRead),
+		HandlerExecution: now.Sub(w.handlerStart),
+	}
+	if body, ok := w.reqBody.(*body); ok {
+		body.mu.Lock()
+		info.BytesRead = body.nread
+		body.mu.Unlock()
+	}
+	if w.heapStart != 0 {
+		info.PeakHeapDelta = int64(heapAlloc() - w.heapStart)
+	}
+	return info
+}
+
+// setTrace makes t the trace whose hooks are called for the rest of
+// w's request. If the connection is not traced, the request's timings
+// start now.
+func (w *response) setTrace(t *httptrace.ServerTrace) {
+	if w.traceID == 0 {
+		w.traceID = atomic.AddUint64(&lastTraceID, 1)
+		now := time.Now()
+		w.traceStart, w.traceRead, w.handlerStart = now, now, now
+	}
+	w.trace = t
+}
+
+// heapAlloc returns the number of bytes of allocated heap objects.
+func heapAlloc() uint64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapAlloc
+}
+
+// presentContextKeys returns the sorted names of the keys in keys
+// for which ctx has a value.
+func presentContextKeys(ctx context.Context, keys map[string]interface{}) []string {
+	var names []string
+	for name, key := range keys {
+		if ctx.Value(key) != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// authScheme returns the authentication scheme of the Authorization
+// header value auth, such as "Basic", without its credentials.
+func authScheme(auth string) string {
+	auth = strings.TrimLeft(auth, " \t")
+	if i := strings.IndexAny(auth, " \t"); i >= 0 {
+		auth = auth[:i]
+	}
+	return auth
+}
+
+// traceProtocol calls the trace's ProtocolNegotiated hook with the
+// protocol the connection is served with.
+func (c *conn) traceProtocol(proto string) {
+	if trace := traceHooks(c.trace, httptrace.ConnectionHooks); trace != nil && trace.ProtocolNegotiated != nil {
+		trace.ProtocolNegotiated(proto)
+	}
+}
+
+// traceHandlerPanic calls the trace's PanicAfterCommit, if the
+// response was committed, and HandlerDone hooks for the current
+// request, if its handler panicked with v. The stack is reported
+// only if the trace's CapturePanicStack is set.
+func (c *conn) traceHandlerPanic(v interface{}, stack []byte) {
+	w, _ := c.curReq.Load().(*response)
+	if w == nil || w.trace == nil || w.handlerDone.isSet() {
+		return
+	}
+	info := w.handlerDoneInfo()
+	info.Panic = v
+	if w.trace.CapturePanicStack {
+		info.PanicStack = stack
+	}
+	if w.cw.wroteHeader {
+		if trace := traceHooks(w.trace, httptrace.ErrorHooks); trace != nil && trace.PanicAfterCommit != nil {
+			trace.PanicAfterCommit(httptrace.PanicInfo{
+				ID:           w.traceID,
+				Value:        v,
+				Stack:        info.PanicStack,
+				StatusCode:   w.status,
+				BytesWritten: w.written,
+			})
+		}
+	}
+	c.summarize(info)
+	if trace := traceHooks(w.trace, httptrace.RequestHooks); trace != nil && trace.HandlerDone != nil {
+		trace.HandlerDone(info)
+	}
+}
+
+// summarize adds the finished request described by info to the
+// connection's summary.
+func (c *conn) summarize(info httptrace.HandlerDoneInfo) {
+	c.summary.Requests++
+	c.summary.BytesRead += info.BytesRead
+	c.summary.BytesWritten += info.BytesWritten
+	if info.StatusCode >= 400 {
+		c.summary.ErrorResponses++
+	}
+}
+
+// traceSummary calls the trace's ConnSummary hook for the closed
+// connection.
+func (c *conn) traceSummary() {
+	if trace := traceHooks(c.trace, httptrace.ConnectionHooks); trace != nil && trace.ConnSummary != nil {
+		info := c.summary
+		info.RemoteAddr = c.remoteAddr
+		info.Duration = time.Since(c.start)
+		trace.ConnSummary(info)
+	}
+}
+
 // http1ServerSupportsRequest reports whether Go's HTTP/1.x server
 // supports the given request.
 func http1ServerSupportsRequest(req *Request) bool {
@@ -1046,6 +1484,11 @@ func (w *response) WriteHeader(code int) {
 	}
 	if w.wroteHeader {
 		w.conn.server.logf("http: multiple response.WriteHeader calls")
+		if code != w.status {
+			if trace := traceHooks(w.trace, httptrace.ErrorHooks); trace != nil && trace.StatusChangeAttempt != nil {
+				trace.StatusChangeAttempt(w.status, code)
+			}
+		}
 		return
 	}
 	w.wroteHeader = true
@@ -1055,6 +1498,48 @@ func (w *response) WriteHeader(code int) {
 		w.cw.header = w.handlerHeader.clone()
 	}
 
+	if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.WroteHeader != nil {
+		trace.WroteHeader(httptrace.WroteHeaderInfo{
+			ID:         w.traceID,
+			StatusCode: code,
+			StatusText: statusLineText(code),
+			Header:     w.handlerHeader,
+		})
+	}
+	if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.CacheHeaders != nil {
+		trace.CacheHeaders(w.cacheInfo())
+	}
+	if code >= 300 && code < 400 {
+		if loc := w.handlerHeader.get("Location"); loc != "" {
+			if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.Redirected != nil {
+				trace.Redirected(httptrace.RedirectInfo{ID: w.traceID, Location: loc, StatusCode: code})
+			}
+		}
+	}
+	if code == StatusMethodNotAllowed {
+		if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.MethodNotAllowed != nil {
+			var allowed []string
+			for _, v := range w.handlerHeader["Allow"] {
+				foreachHeaderElement(v, func(m string) {
+					allowed = append(allowed, m)
+				})
+			}
+			trace.MethodNotAllowed(allowed)
+		}
+	}
+	if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.DuplicateHeader != nil {
+		names := trace.SingleValueHeaders
+		if names == nil {
+			names = defaultSingleValueHeaders
+		}
+		for _, k := range names {
+			k = CanonicalHeaderKey(k)
+			if vv := w.handlerHeader[k]; len(vv) > 1 {
+				trace.DuplicateHeader(k, vv)
+			}
+		}
+	}
+
 	if cl := w.handlerHeader.get("Content-Length"); cl != "" {
 		v, err := strconv.ParseInt(cl, 10, 64)
 		if err == nil && v >= 0 {
@@ -1066,6 +1551,21 @@ func (w *response) WriteHeader(code int) {
 	}
 }
 
+// defaultSingleValueHeaders are the response headers checked by the
+// DuplicateHeader trace hook when the trace does not set
+// SingleValueHeaders.
+var defaultSingleValueHeaders = []string{
+	"Content-Type",
+	"Content-Length",
+	"Content-Range",
+	"Location",
+	"Date",
+	"ETag",
+	"Last-Modified",
+	"Expires",
+	"Retry-After",
+}
+
 // extraHeader is the set of headers sometimes added by chunkWriter.writeHeader.
 // This type is used to avoid extra allocations from cloning and/or populating
 // the response Header map and all its 1-element slices.
@@ -1306,6 +1806,9 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 		_, haveType := header["Content-Type"]
 		if !haveType && !hasTE {
 			setHeader.contentType = DetectContentType(p)
+			if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.SniffedContentType != nil {
+				trace.SniffedContentType(setHeader.contentType)
+			}
 		}
 	} else {
 		for _, k := range suppressedHeaders(code) {
@@ -1314,7 +1817,16 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 	}
 
 	if _, ok := header["Date"]; !ok {
-		setHeader.date = appendTime(cw.res.dateBuf[:0], time.Now())
+		now := time.Now()
+		setHeader.date = appendTime(cw.res.dateBuf[:0], now)
+		if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.WroteDate != nil {
+			trace.WroteDate(now)
+		}
+	}
+	if v := header.get("Server"); v != "" {
+		if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.WroteServerHeader != nil {
+			trace.WroteServerHeader(v)
+		}
 	}
 
 	if hasCL && hasTE && te != "identity" {
@@ -1340,6 +1852,7 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 		// section 8.
 		if hasTE && te == "identity" {
 			cw.chunking = false
+			cw.closeFraming = true
 			w.closeAfterReply = true
 		} else {
 			// HTTP/1.1 or greater: use chunked transfer encoding
@@ -1349,12 +1862,15 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 			if hasTE && te == "chunked" {
 				// We will send the chunked Transfer-Encoding header later.
 				delHeader("Transfer-Encoding")
+			} else if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.AutoChunked != nil {
+				trace.AutoChunked()
 			}
 		}
 	} else {
 		// HTTP version < 1.1: cannot do chunked transfer
 		// encoding and we don't know the Content-Length so
 		// signal EOF by closing connection.
+		cw.closeFraming = true
 		w.closeAfterReply = true
 		delHeader("Transfer-Encoding") // in case already set
 	}
@@ -1374,6 +1890,18 @@ func (cw *chunkWriter) writeHeader(p []byte) {
 		}
 	}
 
+	if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.HeaderSanitized != nil {
+		for k, vv := range cw.header {
+			if excludeHeader[k] {
+				continue
+			}
+			for _, v := range vv {
+				if strings.ContainsAny(v, "\r\n") {
+					trace.HeaderSanitized(k, v)
+				}
+			}
+		}
+	}
 	writeStatusLine(w.conn.bufw, w.req.ProtoAtLeast(1, 1), code, w.statusBuf[:])
 	cw.header.WriteSubset(w.conn.bufw, excludeHeader)
 	setHeader.Write(w.conn.bufw)
@@ -1415,10 +1943,19 @@ func writeStatusLine(bw *bufio.Writer, is11 bool, code int, scratch []byte) {
 		bw.WriteString("\r\n")
 	} else {
 		// don't worry about performance
-		fmt.Fprintf(bw, "%03d status code %d\r\n", code, code)
+		fmt.Fprintf(bw, "%03d %s\r\n", code, statusLineText(code))
 	}
 }
 
+// statusLineText returns the reason phrase writeStatusLine sends
+// for code.
+func statusLineText(code int) string {
+	if text, ok := statusText[code]; ok {
+		return text
+	}
+	return "status code " + strconv.Itoa(code)
+}
+
 // bodyAllowed reports whether a Write is allowed for this response type.
 // It's illegal to call this before the header has been flushed.
 func (w *response) bodyAllowed() bool {
@@ -1492,11 +2029,41 @@ func (w *response) write(lenData int, dataB []byte, dataS string) (n int, err er
 	if w.contentLength != -1 && w.written > w.contentLength {
 		return 0, ErrContentLength
 	}
+	w.writes++
+	trace := traceHooks(w.trace, httptrace.BodyHooks)
+	if trace != nil && trace.GotResponsePrefix != nil && len(w.bodyPrefix) < trace.CaptureResponseBody {
+		n := trace.CaptureResponseBody - len(w.bodyPrefix)
+		if n > lenData {
+			n = lenData
+		}
+		if dataB != nil {
+			w.bodyPrefix = append(w.bodyPrefix, dataB[:n]...)
+		} else {
+			w.bodyPrefix = append(w.bodyPrefix, dataS[:n]...)
+		}
+	}
+	if trace != nil && trace.WriteBlocked != nil && trace.WriteBlockThreshold > 0 {
+		t0 := time.Now()
+		defer func() {
+			if d := time.Since(t0); d >= trace.WriteBlockThreshold {
+				trace.WriteBlocked(d)
+			}
+		}()
+	}
 	if dataB != nil {
-		return w.w.Write(dataB)
+		n, err = w.w.Write(dataB)
 	} else {
-		return w.w.WriteString(dataS)
+		n, err = w.w.WriteString(dataS)
 	}
+	if err != nil && w.conn.werr != nil && !w.truncated {
+		w.truncated = true
+		w.truncatedAt = w.written - int64(lenData) + int64(n)
+	}
+	if trace != nil && trace.WroteBodyChunk != nil && (trace.MaxChunkHooks <= 0 || w.chunkHooks < trace.MaxChunkHooks) {
+		w.chunkHooks++
+		trace.WroteBodyChunk(httptrace.WroteBodyChunkInfo{ID: w.traceID, Len: n, Err: err})
+	}
+	return n, err
 }
 
 func (w *response) finishRequest() {
@@ -1510,6 +2077,18 @@ func (w *response) finishRequest() {
 	putBufioWriter(w.w)
 	w.cw.close()
 	w.conn.bufw.Flush()
+	if w.cw.chunking && w.conn.werr == nil {
+		if trace := traceHooks(w.trace, httptrace.BodyHooks); trace != nil && trace.WroteFinalChunk != nil {
+			trace.WroteFinalChunk(w.cw.trailers)
+		}
+	}
+	w.traceTruncated()
+	w.traceNoContentLength()
+	if w.cw.discarded > 0 {
+		if trace := traceHooks(w.trace, httptrace.BodyHooks); trace != nil && trace.HeadBodyDiscarded != nil {
+			trace.HeadBodyDiscarded(w.cw.discarded)
+		}
+	}
 
 	w.conn.r.abortPendingRead()
 
@@ -1517,11 +2096,54 @@ func (w *response) finishRequest() {
 	// re-use its bufio.Reader later safely.
 	w.reqBody.Close()
 
+	if w.conn.trace != nil {
+		w.conn.r.lock()
+		w.conn.pipelined = w.conn.bufr.Buffered() > 0 || w.conn.r.hasByte
+		w.conn.r.unlock()
+	}
+
 	if w.req.MultipartForm != nil {
 		w.req.MultipartForm.RemoveAll()
 	}
 }
 
+// traceTruncated calls the ResponseTruncated trace hook, if any, if
+// writing w's body to the connection failed.
+func (w *response) traceTruncated() {
+	if w.conn.werr == nil || w.req.Method == "HEAD" || !w.bodyAllowed() {
+		return
+	}
+	if trace := traceHooks(w.trace, httptrace.BodyHooks); trace != nil && trace.ResponseTruncated != nil {
+		written := w.written
+		if w.truncated {
+			written = w.truncatedAt
+		}
+		trace.ResponseTruncated(written, w.contentLength)
+	}
+}
+
+// traceNoContentLength calls the NoContentLength trace hook, if any,
+// if w's body was written without a Content-Length.
+func (w *response) traceNoContentLength() {
+	var framing string
+	switch {
+	case w.cw.chunking:
+		framing = "chunked"
+	case w.cw.closeFraming:
+		framing = "close"
+	default:
+		return
+	}
+	if trace := traceHooks(w.trace, httptrace.ResponseHooks); trace != nil && trace.NoContentLength != nil {
+		trace.NoContentLength(httptrace.NoContentLengthInfo{
+			ID:         w.traceID,
+			Method:     w.req.Method,
+			StatusCode: w.status,
+			Framing:    framing,
+		})
+	}
+}
+
 // shouldReuseConnection reports whether the underlying TCP connection can be reused.
 // It must only be called after the handler is done executing.
 func (w *response) shouldReuseConnection() bool {
@@ -1556,6 +2178,7 @@ func (w *response) closedRequestBodyEarly() bool {
 }
 
 func (w *response) Flush() {
+	w.flushes++
 	if !w.wroteHeader {
 		w.WriteHeader(StatusOK)
 	}
@@ -1685,20 +2308,44 @@ func isCommonNetReadError(err error) bool {
 // Serve a new connection.
 func (c *conn) serve(ctx context.Context) {
 	c.remoteAddr = c.rwc.RemoteAddr().String()
+	c.trace = httptrace.ContextServerTrace(ctx)
+	if c.trace != nil {
+		c.start = time.Now()
+	}
 	ctx = context.WithValue(ctx, LocalAddrContextKey, c.rwc.LocalAddr())
 	defer func() {
-		if err := recover(); err != nil && err != ErrAbortHandler {
+		err := recover()
+		var stack []byte
+		trace := c.trace
+		if w, _ := c.curReq.Load().(*response); w != nil {
+			trace = w.trace
+		}
+		if err != nil && (err != ErrAbortHandler || trace != nil && trace.CapturePanicStack) {
 			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			c.server.logf("http: panic serving %v: %v\n%s", c.remoteAddr, err, buf)
+			stack = make([]byte, size)
+			stack = stack[:runtime.Stack(stack, false)]
+		}
+		if err != nil && err != ErrAbortHandler {
+			c.server.logf("http: panic serving %v: %v\n%s", c.remoteAddr, err, stack)
+		}
+		if err != nil && trace != nil && !c.hijacked() {
+			c.traceHandlerPanic(err, stack)
 		}
 		if !c.hijacked() {
 			c.close()
 			c.setState(c.rwc, StateClosed)
+			if c.r != nil {
+				c.traceSummary()
+			}
 		}
 	}()
 
+	if trace := traceHooks(c.trace, httptrace.ConnectionHooks); trace != nil && trace.SocketOptions != nil {
+		if info, ok := socketOptions(c.rwc); ok {
+			trace.SocketOptions(info)
+		}
+	}
+
 	if tlsConn, ok := c.rwc.(*tls.Conn); ok {
 		if d := c.server.ReadTimeout; d != 0 {
 			c.rwc.SetReadDeadline(time.Now().Add(d))
@@ -1708,12 +2355,16 @@ func (c *conn) serve(ctx context.Context) {
 		}
 		if err := tlsConn.Handshake(); err != nil {
 			c.server.logf("http: TLS handshake error from %s: %v", c.rwc.RemoteAddr(), err)
+			if trace := traceHooks(c.trace, httptrace.ConnectionHooks); trace != nil && trace.TLSHandshakeError != nil {
+				trace.TLSHandshakeError(err)
+			}
 			return
 		}
 		c.tlsState = new(tls.ConnectionState)
 		*c.tlsState = tlsConn.ConnectionState()
 		if proto := c.tlsState.NegotiatedProtocol; validNPN(proto) {
 			if fn := c.server.TLSNextProto[proto]; fn != nil {
+				c.traceProtocol(proto)
 				h := initNPNRequest{tlsConn, serverHandler{c.server}}
 				fn(c.server, tlsConn, h)
 			}
@@ -1722,14 +2373,16 @@ func (c *conn) serve(ctx context.Context) {
 	}
 
 	// HTTP/1.x from here on.
+	c.traceProtocol("http/1.1")
 
 	ctx, cancelCtx := context.WithCancel(ctx)
+	c.ctx = ctx
 	c.cancelCtx = cancelCtx
 	defer cancelCtx()
 
 	c.r = &connReader{conn: c}
-	c.bufr = newBufioReader(c.r)
-	c.bufw = newBufioWriterSize(checkConnErrorWriter{c}, 4<<10)
+	c.bufr = newBufioReader(c.r, c.trace)
+	c.bufw = newBufioWriterSize(checkConnErrorWriter{c}, 4<<10, c.trace)
 
 	for {
 		w, err := c.readRequest(ctx)
@@ -1755,6 +2408,17 @@ func (c *conn) serve(ctx context.Context) {
 				return // don't reply
 			}
 
+			if fe, ok := err.(*framingError); ok {
+				if trace := traceHooks(c.trace, httptrace.ErrorHooks); trace != nil && trace.SmugglingRejected != nil {
+					trace.SmugglingRejected(httptrace.SmugglingInfo{
+						Reason:        fe.reason,
+						DuplicateHost: fe.reason == "multiple Host headers",
+						Err:           err,
+					})
+				}
+				err = fe.err
+			}
+
 			publicErr := "400 Bad Request"
 			if v, ok := err.(badRequestError); ok {
 				publicErr = publicErr + ": " + string(v)
@@ -1764,8 +2428,66 @@ func (c *conn) serve(ctx context.Context) {
 			return
 		}
 
-		// Expect 100 Continue support
 		req := w.req
+		if c.trace != nil {
+			w.traceRead = time.Now()
+		}
+		limited := false
+		if c.server.MaxRequestsPerConn > 0 {
+			c.requests++
+			if c.requests >= c.server.MaxRequestsPerConn {
+				w.closeAfterReply = true
+				limited = true
+			}
+		}
+		if trace := traceHooks(c.trace, httptrace.RequestHooks); trace != nil {
+			if trace.MeasurePeakHeap {
+				w.heapStart = heapAlloc()
+			}
+			if trace.GotRequest != nil {
+				trace.GotRequest(w.requestInfo())
+			}
+			if trace.GotContextKeys != nil && len(trace.ContextKeys) > 0 {
+				trace.GotContextKeys(presentContextKeys(req.Context(), trace.ContextKeys))
+			}
+			if trace.EffectiveDeadline != nil {
+				if d, source := w.effectiveDeadline(); !d.IsZero() {
+					trace.EffectiveDeadline(httptrace.DeadlineSourceInfo{ID: w.traceID, Deadline: d, Source: source})
+				}
+			}
+			if trace.GotQuery != nil && req.URL.RawQuery != "" {
+				trace.GotQuery(url.ParseQuery(req.URL.RawQuery))
+			}
+			if trace.GotCookie != nil {
+				for _, c := range req.Cookies() {
+					trace.GotCookie(c.Name, c.Value)
+				}
+			}
+			if trace.GotTraceContext != nil {
+				if tp := req.Header.get("Traceparent"); tp != "" {
+					trace.GotTraceContext(tp, req.Header.get("Tracestate"))
+				}
+			}
+			if trace.TargetNormalized != nil && strings.HasPrefix(req.RequestURI, "/") {
+				raw := req.RequestURI
+				if i := strings.IndexByte(raw, '?'); i >= 0 {
+					raw = raw[:i]
+				}
+				if raw != req.URL.Path {
+					trace.TargetNormalized(raw, req.URL.Path)
+				}
+			}
+			if trace.GotAbsoluteURI != nil && req.URL.IsAbs() {
+				trace.GotAbsoluteURI(req.RequestURI)
+			}
+			if trace.GotAuthScheme != nil {
+				if scheme := authScheme(req.Header.get("Authorization")); scheme != "" {
+					trace.GotAuthScheme(scheme)
+				}
+			}
+		}
+
+		// Expect 100 Continue support
 		if req.expectsContinue() {
 			if req.ProtoAtLeast(1, 1) && req.ContentLength != 0 {
 				// Wrap the Body reader with one that replies on the connection
@@ -1794,16 +2516,33 @@ func (c *conn) serve(ctx context.Context) {
 		// in parallel even if their responses need to be serialized.
 		// But we're not going to implement HTTP pipelining because it
 		// was never deployed in the wild and the answer is HTTP/2.
+		if c.trace != nil {
+			w.handlerStart = time.Now()
+		}
 		serverHandler{c.server}.ServeHTTP(w, w.req)
 		w.cancelCtx()
 		if c.hijacked() {
 			return
 		}
 		w.finishRequest()
+		if w.trace != nil {
+			if trace := traceHooks(w.trace, httptrace.BodyHooks); trace != nil && trace.GotResponsePrefix != nil && len(w.bodyPrefix) > 0 {
+				trace.GotResponsePrefix(w.bodyPrefix)
+			}
+			info := w.handlerDoneInfo()
+			info.KeepAliveHonored = w.wants10KeepAlive && w.shouldReuseConnection()
+			c.summarize(info)
+			if trace := traceHooks(w.trace, httptrace.RequestHooks); trace != nil && trace.HandlerDone != nil {
+				trace.HandlerDone(info)
+			}
+		}
 		if !w.shouldReuseConnection() {
 			if w.requestBodyLimitHit || w.closedRequestBodyEarly() {
 				c.closeWriteAndWait()
 			}
+			if trace := traceHooks(c.trace, httptrace.ConnectionHooks); limited && trace != nil && trace.RequestsPerConnLimitReached != nil {
+				trace.RequestsPerConnLimitReached()
+			}
 			return
 		}
 		c.setState(c.rwc, StateIdle)
@@ -1865,6 +2604,8 @@ func (w *response) Hijack() (rwc net.Conn, buf *bufio.ReadWriter, err error) {
 	if err == nil {
 		putBufioWriter(w.w)
 		w.w = nil
+	} else if trace := traceHooks(w.trace, httptrace.ErrorHooks); trace != nil && trace.HijackFailed != nil {
+		trace.HijackFailed(err)
 	}
 	return rwc, buf, err
 }
@@ -1957,6 +2698,36 @@ func StripPrefix(prefix string, h Handler) Handler {
 	})
 }
 
+// TraceHandler returns a handler that serves HTTP requests by
+// invoking the handler h with trace registered, as if with
+// httptrace.WithServerTrace, in the context of each request for
+// which sample returns true. Other requests are passed to h
+// unchanged. If sample is nil, every request is traced.
+//
+// The server also calls trace's hooks for the rest of a traced
+// request, such as WroteHeader, WroteBodyChunk and HandlerDone,
+// provided the ResponseWriter passed to the returned handler is the
+// server's own. Hooks for events before the handler was called, such
+// as GotRequest, are not called, and the timings in HandlerDoneInfo
+// start when the handler was called unless the server has a trace of
+// its own. The trace must not be modified after TraceHandler is called.
+func TraceHandler(h Handler, trace *httptrace.ServerTrace, sample func(*Request) bool) Handler {
+	if trace == nil {
+		panic("http: nil trace")
+	}
+	return HandlerFunc(func(w ResponseWriter, r *Request) {
+		if sample != nil && !sample(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx := httptrace.WithServerTrace(r.Context(), trace)
+		if rw, ok := w.(*response); ok {
+			rw.setTrace(httptrace.ContextServerTrace(ctx))
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 // Redirect replies to the request with a redirect to url,
 // which may be a path relative to the request path.
 //
@@ -2203,6 +2974,9 @@ func (mux *ServeMux) Handler(r *Request) (h Handler, pattern string) {
 	host := stripHostPort(r.Host)
 	path := cleanPath(r.URL.Path)
 	if path != r.URL.Path {
+		if trace := traceHooks(httptrace.ContextServerTrace(r.Context()), httptrace.RequestHooks); trace != nil && trace.PathCleaned != nil {
+			trace.PathCleaned(r.URL.Path, path)
+		}
 		_, pattern = mux.handler(host, path)
 		url := *r.URL
 		url.Path = path
@@ -2370,6 +3144,13 @@ type Server struct {
 	// If zero, DefaultMaxHeaderBytes is used.
 	MaxHeaderBytes int
 
+	// MaxRequestsPerConn limits the number of requests the server
+	// serves on each HTTP/1.x connection. The response to the
+	// last request has a "Connection: close" header, and the
+	// connection is closed after it. If MaxRequestsPerConn is
+	// zero, there is no limit.
+	MaxRequestsPerConn int
+
 	// TLSNextProto optionally specifies a function to take over
 	// ownership of the provided TLS connection when an NPN/ALPN
 	// protocol upgrade has occurred. The map key is the protocol
@@ -2392,6 +3173,13 @@ type Server struct {
 	// standard logger.
 	ErrorLog *log.Logger
 
+	// Trace optionally specifies hooks to run at various stages of
+	// serving each request. It is installed in the context of
+	// every request served, where handlers may retrieve it with
+	// httptrace.ContextServerTrace. The Trace must not be modified
+	// after calling Serve.
+	Trace *httptrace.ServerTrace
+
 	disableKeepAlives int32     // accessed atomically.
 	inShutdown        int32     // accessed atomically (non-zero means we're in Shutdown)
 	nextProtoOnce     sync.Once // guards setupHTTP2_* init
@@ -2447,6 +3235,15 @@ func (srv *Server) Close() error {
 		c.rwc.Close()
 		delete(srv.activeConn, c)
 	}
+	return srv.traceShutdown(err)
+}
+
+// traceShutdown calls the ServeShutdown hook of the server's trace,
+// if any, with err, the result of Close or Shutdown, and returns err.
+func (srv *Server) traceShutdown(err error) error {
+	if trace := traceHooks(srv.Trace, httptrace.ConnectionHooks); trace != nil && trace.ServeShutdown != nil {
+		trace.ServeShutdown(err)
+	}
 	return err
 }
 
@@ -2491,11 +3288,11 @@ func (srv *Server) Shutdown(ctx context.Context) error {
 	defer ticker.Stop()
 	for {
 		if srv.closeIdleConns() {
-			return lnerr
+			return srv.traceShutdown(lnerr)
 		}
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
+			return srv.traceShutdown(ctx.Err())
 		case <-ticker.C:
 		}
 	}
@@ -2606,6 +3403,9 @@ func (sh serverHandler) ServeHTTP(rw ResponseWriter, req *Request) {
 	}
 	if req.RequestURI == "*" && req.Method == "OPTIONS" {
 		handler = globalOptionsHandler{}
+		if trace := traceHooks(httptrace.ContextServerTrace(req.Context()), httptrace.RequestHooks); trace != nil && trace.GotServerOptions != nil {
+			trace.GotServerOptions()
+		}
 	}
 	handler.ServeHTTP(rw, req)
 }
@@ -2682,6 +3482,12 @@ func (srv *Server) Serve(l net.Listener) error {
 
 	baseCtx := context.Background() // base is always background, per Issue 16220
 	ctx := context.WithValue(baseCtx, ServerContextKey, srv)
+	if srv.Trace != nil {
+		ctx = httptrace.WithServerTrace(ctx, srv.Trace)
+	}
+	if trace := traceHooks(httptrace.ContextServerTrace(ctx), httptrace.ConnectionHooks); trace != nil && trace.ServeStart != nil {
+		trace.ServeStart(l.Addr())
+	}
 	for {
 		rw, e := l.Accept()
 		if e != nil {
@@ -2989,6 +3795,9 @@ func (srv *Server) onceSetNextProtoDefaults() {
 //
 // TimeoutHandler buffers all Handler writes to memory and does not
 // support the Hijacker or Flusher interfaces.
+//
+// If the request's context carries an httptrace.ServerTrace, its
+// HandlerTimeout hook is called when h exceeds the time limit.
 func TimeoutHandler(h Handler, dt time.Duration, msg string) Handler {
 	return &timeoutHandler{
 		handler: h,
@@ -3025,6 +3834,14 @@ func (h *timeoutHandler) ServeHTTP(w ResponseWriter, r *Request) {
 		t = time.NewTimer(h.dt)
 		timeout = t.C
 	}
+	// If w is the server's ResponseWriter, report h's time limit
+	// to its trace.
+	type handlerDeadlineTracer interface {
+		traceHandlerDeadline(time.Time)
+	}
+	if dt, ok := w.(handlerDeadlineTracer); ok {
+		dt.traceHandlerDeadline(time.Now().Add(h.dt))
+	}
 	done := make(chan struct{})
 	tw := &timeoutWriter{
 		w: w,
@@ -3056,6 +3873,9 @@ func (h *timeoutHandler) ServeHTTP(w ResponseWriter, r *Request) {
 		w.WriteHeader(StatusServiceUnavailable)
 		io.WriteString(w, h.errorBody())
 		tw.timedOut = true
+		if trace := traceHooks(httptrace.ContextServerTrace(r.Context()), httptrace.ErrorHooks); trace != nil && trace.HandlerTimeout != nil {
+			trace.HandlerTimeout(h.dt)
+		}
 		return
 	}
 }
@@ -3206,8 +4026,10 @@ type checkConnErrorWriter struct {
 
 func (w checkConnErrorWriter) Write(p []byte) (n int, err error) {
 	n, err = w.c.rwc.Write(p)
+	w.c.wireBytes += int64(n)
 	if err != nil && w.c.werr == nil {
 		w.c.werr = err
+		w.c.traceReset(err)
 		w.c.cancelCtx()
 	}
 	return
@@ -0,0 +1,3280 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Tests for the server-side httptrace hooks.
+
+package http_test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	. "net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServerTraceBodyReadStall(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	var (
+		mu     sync.Mutex
+		stalls []httptrace.BodyReadStallInfo
+	)
+	done := make(chan bool, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		slurp, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("ReadAll: %v", err)
+		}
+		if string(slurp) != "helloworld" {
+			t.Errorf("body = %q; want %q", slurp, "helloworld")
+		}
+		done <- true
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		StallThreshold: 50 * time.Millisecond,
+		BodyReadStall: func(info httptrace.BodyReadStallInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			stalls = append(stalls, info)
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "POST / HTTP/1.1\r\nHost: foo\r\nContent-Length: 10\r\n\r\nhello")
+	time.Sleep(250 * time.Millisecond)
+	fmt.Fprintf(c, "world")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for handler")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stalls) == 0 {
+		t.Fatal("BodyReadStall not called")
+	}
+	if got := stalls[len(stalls)-1].BytesRead; got != 5 {
+		t.Errorf("BytesRead = %d; want 5", got)
+	}
+}
+
+func TestServerTraceNoBodyReadStall(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	var stalled int32
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		StallThreshold: time.Minute,
+		BodyReadStall: func(httptrace.BodyReadStallInfo) {
+			atomic.AddInt32(&stalled, 1)
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if n := atomic.LoadInt32(&stalled); n != 0 {
+		t.Errorf("BodyReadStall called %d times; want 0", n)
+	}
+}
+
+func TestServerTraceGotRequestServerName(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	gotReq := make(chan httptrace.RequestInfo, 1)
+	trace := &httptrace.ServerTrace{
+		GotRequest: func(info httptrace.RequestInfo) {
+			gotReq <- info
+		},
+	}
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {})
+
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.Trace = trace
+	ts.StartTLS()
+	defer ts.Close()
+	c := ts.Client()
+	c.Transport.(*Transport).TLSClientConfig.ServerName = "example.com"
+	res, err := c.Get(ts.URL + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	info := <-gotReq
+	if info.ServerName != "example.com" {
+		t.Errorf("ServerName = %q; want %q", info.ServerName, "example.com")
+	}
+	if info.Method != "GET" || info.RequestURI != "/foo" {
+		t.Errorf("got %s %s; want GET /foo", info.Method, info.RequestURI)
+	}
+
+	ts = httptest.NewUnstartedServer(handler)
+	ts.Config.Trace = trace
+	ts.Start()
+	defer ts.Close()
+	res, err = ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if info := <-gotReq; info.ServerName != "" {
+		t.Errorf("plaintext ServerName = %q; want empty", info.ServerName)
+	}
+}
+
+func TestServerTraceWriteBlocked(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	blocked := make(chan time.Duration, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		chunk := make([]byte, 32<<10)
+		for i := 0; i < 1024 && len(blocked) == 0; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	const threshold = 50 * time.Millisecond
+	ts.Config.Trace = &httptrace.ServerTrace{
+		WriteBlockThreshold: threshold,
+		WriteBlocked: func(d time.Duration) {
+			select {
+			case blocked <- d:
+			default:
+			}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: foo\r\nConnection: close\r\n\r\n")
+	time.Sleep(500 * time.Millisecond) // let the server's writes back up
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case d := <-blocked:
+		if d < threshold {
+			t.Errorf("WriteBlocked duration = %v; want >= %v", d, threshold)
+		}
+	default:
+		t.Fatal("WriteBlocked not called")
+	}
+}
+
+func TestServerTraceHandlerDone(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	var (
+		mu     sync.Mutex
+		events []string
+		done   httptrace.HandlerDoneInfo
+		gotID  uint64
+	)
+	record := func(ev string) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, ev)
+	}
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(StatusTeapot)
+		io.WriteString(w, "hello")
+		io.WriteString(w, "world")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequest: func(info httptrace.RequestInfo) {
+			mu.Lock()
+			gotID = info.ID
+			mu.Unlock()
+			record("GotRequest")
+		},
+		WroteHeader: func(info httptrace.WroteHeaderInfo) {
+			record(fmt.Sprintf("WroteHeader %d", info.StatusCode))
+		},
+		WroteBodyChunk: func(info httptrace.WroteBodyChunkInfo) {
+			record(fmt.Sprintf("WroteBodyChunk %d", info.Len))
+		},
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			mu.Lock()
+			done = info
+			mu.Unlock()
+			record("HandlerDone")
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL, "text/plain", strings.NewReader("abc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// HandlerDone runs after the response is flushed, so the
+	// client may see the response first.
+	waitCondition(5*time.Second, 10*time.Millisecond, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return done.ID != 0
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"GotRequest", "WroteHeader 418", "WroteBodyChunk 5", "WroteBodyChunk 5", "HandlerDone"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %q; want %q", events, want)
+	}
+	if done.ID != gotID || done.StatusCode != StatusTeapot || done.BytesRead != 3 || done.BytesWritten != 10 {
+		t.Errorf("HandlerDone info = %+v", done)
+	}
+}
+
+func TestServerTraceMaxChunkHooks(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	const chunks = 1000
+	var calls int32
+	done := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		for i := 0; i < chunks; i++ {
+			io.WriteString(w, "x")
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		WroteBodyChunk: func(httptrace.WroteBodyChunkInfo) {
+			atomic.AddInt32(&calls, 1)
+		},
+		MaxChunkHooks: 10,
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			done <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	info := <-done
+	if n := atomic.LoadInt32(&calls); n != 10 {
+		t.Errorf("WroteBodyChunk called %d times; want 10", n)
+	}
+	if info.BytesWritten != chunks {
+		t.Errorf("BytesWritten = %d; want %d", info.BytesWritten, chunks)
+	}
+}
+
+func TestServerTraceWriteCount(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	done := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "hello")
+			if i%2 == 1 {
+				w.(Flusher).Flush()
+			}
+		}
+		io.WriteString(w, "")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			done <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	info := <-done
+	if info.WriteCount != 5 || info.FlushCount != 2 {
+		t.Errorf("WriteCount, FlushCount = %d, %d; want 5, 2", info.WriteCount, info.FlushCount)
+	}
+}
+
+func TestServerTraceWriteCountRejected(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	done := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch r.URL.Path {
+		case "/nocontent":
+			w.WriteHeader(StatusNoContent)
+		case "/length":
+			w.Header().Set("Content-Length", "5")
+			io.WriteString(w, "hello")
+		}
+		if _, err := io.WriteString(w, "extra"); err == nil {
+			t.Errorf("%s: Write succeeded; want an error", r.URL.Path)
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			done <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/nocontent", 0},
+		{"/length", 1},
+	} {
+		res, err := ts.Client().Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if info := <-done; info.WriteCount != tt.want {
+			t.Errorf("%s: WriteCount = %d; want %d", tt.path, info.WriteCount, tt.want)
+		}
+	}
+}
+
+func TestServerTraceWireBytesWritten(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	done := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "hello")
+		w.(Flusher).Flush()
+		io.WriteString(w, "world")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			done <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: foo\r\nConnection: close\r\n\r\n")
+	wire, err := ioutil.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(wire), "Transfer-Encoding: chunked") {
+		t.Fatalf("response is not chunked:\n%s", wire)
+	}
+	info := <-done
+	if info.BytesWritten != 10 {
+		t.Errorf("BytesWritten = %d; want 10", info.BytesWritten)
+	}
+	if info.WireBytesWritten != int64(len(wire)) {
+		t.Errorf("WireBytesWritten = %d; want %d, the length of the response", info.WireBytesWritten, len(wire))
+	}
+}
+
+func TestServerTraceKeepAliveHonored(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	done := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/length" {
+			w.Header().Set("Content-Length", "2")
+		}
+		io.WriteString(w, "ok")
+		w.(Flusher).Flush()
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			done <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		req  string
+		want bool
+	}{
+		{"GET /length HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", true},
+		{"GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n", false},
+		{"GET /length HTTP/1.0\r\n\r\n", false},
+		{"GET /length HTTP/1.1\r\nHost: foo\r\n\r\n", false},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, tt.req)
+		res, err := ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.req, err)
+		}
+		res.Body.Close()
+		c.Close()
+		if info := <-done; info.KeepAliveHonored != tt.want {
+			t.Errorf("%q: KeepAliveHonored = %v; want %v", tt.req, info.KeepAliveHonored, tt.want)
+		}
+	}
+}
+
+func TestServerTraceMaxRequestsPerConn(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	limited := make(chan bool, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "ok")
+	}))
+	ts.Config.MaxRequestsPerConn = 2
+	ts.Config.Trace = &httptrace.ServerTrace{
+		RequestsPerConnLimitReached: func() {
+			limited <- true
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for i, wantClose := range []bool{false, true} {
+		io.WriteString(c, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+		res, err := ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.Close != wantClose {
+			t.Errorf("request %d: Close = %v; want %v", i, res.Close, wantClose)
+		}
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("read after last response = %v; want EOF", err)
+	}
+	select {
+	case <-limited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RequestsPerConnLimitReached not called")
+	}
+	select {
+	case <-limited:
+		t.Error("RequestsPerConnLimitReached called more than once")
+	default:
+	}
+}
+
+func TestServerTraceServeStartShutdown(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	started := make(chan net.Addr, 1)
+	shutdown := make(chan error, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		ServeStart: func(addr net.Addr) {
+			started <- addr
+		},
+		ServeShutdown: func(err error) {
+			shutdown <- err
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	select {
+	case addr := <-started:
+		if addr.String() != ts.Listener.Addr().String() {
+			t.Errorf("ServeStart(%v); want %v", addr, ts.Listener.Addr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeStart not called")
+	}
+	if err := ts.Config.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Errorf("ServeShutdown(%v); want nil", err)
+		}
+	default:
+		t.Fatal("ServeShutdown not called")
+	}
+}
+
+func TestServerTraceServeTwice(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	slow := make(chan string, 4)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	trace := &httptrace.ServerTrace{
+		GotMethod: func(string) {
+			time.Sleep(2 * time.Millisecond)
+		},
+		HookBudget: time.Millisecond,
+		SlowHook: func(hook string, d time.Duration) {
+			slow <- hook
+		},
+	}
+	ts.Config.Trace = trace
+	ts.Start()
+	defer ts.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ts.Config.Serve(ln)
+
+	for _, addr := range []string{ts.Listener.Addr().String(), ln.Addr().String()} {
+		res, err := ts.Client().Get("http://" + addr + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if n := len(slow); n != 2 {
+		t.Errorf("SlowHook called %d times for 2 requests; want 2", n)
+	}
+	if ts.Config.Trace != trace || trace.GotMethod == nil || trace.HookBudget != time.Millisecond {
+		t.Error("Serve modified the Server's Trace")
+	}
+}
+
+func TestServerTraceWroteFinalChunk(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	events := make(chan string, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/trailers" {
+			w.Header().Set("Trailer", "X-Sum")
+		}
+		io.WriteString(w, "hello")
+		if r.URL.Path != "/length" {
+			w.(Flusher).Flush()
+		}
+		io.WriteString(w, "world")
+		w.Header().Set("X-Sum", "10")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		WroteFinalChunk: func(hasTrailers bool) {
+			events <- fmt.Sprintf("WroteFinalChunk %v", hasTrailers)
+		},
+		HandlerDone: func(httptrace.HandlerDoneInfo) {
+			events <- "HandlerDone"
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"/", []string{"WroteFinalChunk false", "HandlerDone"}},
+		{"/trailers", []string{"WroteFinalChunk true", "HandlerDone"}},
+		{"/length", []string{"HandlerDone"}},
+	} {
+		res, err := ts.Client().Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		var got []string
+		for len(got) == 0 || got[len(got)-1] != "HandlerDone" {
+			select {
+			case ev := <-events:
+				got = append(got, ev)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: HandlerDone not called", tt.path)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: events = %q; want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestServerTraceGotRequestBodyType(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	body := "\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat("x", 1000)
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		r.Body = SniffingBody(r)
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if string(b) != body {
+			t.Errorf("handler read %d bytes; want the %d byte body", len(b), len(body))
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequestBodyType: func(ct string) {
+			got <- ct
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL, "application/octet-stream", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case ct := <-got:
+		if ct != "image/png" {
+			t.Errorf("GotRequestBodyType(%q); want %q", ct, "image/png")
+		}
+	default:
+		t.Fatal("GotRequestBodyType not called")
+	}
+}
+
+func TestServerTraceStatusClass(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	done := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.WriteHeader(code)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			done <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		code, class int
+	}{
+		{StatusOK, 2},
+		{StatusNotFound, 4},
+		{StatusServiceUnavailable, 5},
+	} {
+		res, err := ts.Client().Get(ts.URL + "/?code=" + fmt.Sprint(tt.code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if info := <-done; info.StatusClass != tt.class {
+			t.Errorf("%d: StatusClass = %d; want %d", tt.code, info.StatusClass, tt.class)
+		}
+	}
+}
+
+func TestServerTraceStatusText(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.WriteHeader(code)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		WroteHeader: func(info httptrace.WroteHeaderInfo) {
+			got <- info.StatusText
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		code int
+		want string
+	}{
+		{StatusTeapot, "I'm a teapot"},
+		{299, "status code 299"},
+	} {
+		res, err := ts.Client().Get(ts.URL + "/?code=" + fmt.Sprint(tt.code))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		text := <-got
+		if text != tt.want {
+			t.Errorf("%d: StatusText = %q; want %q", tt.code, text, tt.want)
+		}
+		if wantStatus := fmt.Sprintf("%d %s", tt.code, text); res.Status != wantStatus {
+			t.Errorf("%d: client got status %q; want %q", tt.code, res.Status, wantStatus)
+		}
+	}
+}
+
+func TestServerTraceCacheHeaders(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.CacheInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Cache-Control", `public, max-age=60, no-cache="Set-Cookie"`)
+		w.Header().Add("Cache-Control", "No-Transform")
+		w.Header().Set("ETag", `"abc"`)
+		w.Header().Set("Vary", "Accept-Encoding, Accept-Language")
+		io.WriteString(w, "hello")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		CacheHeaders: func(info httptrace.CacheInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	info := <-got
+	wantCC := map[string]string{
+		"public":       "",
+		"max-age":      "60",
+		"no-cache":     "Set-Cookie",
+		"no-transform": "",
+	}
+	if !reflect.DeepEqual(info.CacheControl, wantCC) {
+		t.Errorf("CacheControl = %v; want %v", info.CacheControl, wantCC)
+	}
+	if info.ETag != `"abc"` {
+		t.Errorf("ETag = %q; want %q", info.ETag, `"abc"`)
+	}
+	if want := []string{"Accept-Encoding", "Accept-Language"}; !reflect.DeepEqual(info.Vary, want) {
+		t.Errorf("Vary = %q; want %q", info.Vary, want)
+	}
+}
+
+func TestServerTraceHandlerTimeout(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	const limit = 50 * time.Millisecond
+	got := make(chan time.Duration, 1)
+	unblock := make(chan bool)
+	defer close(unblock)
+	h := TimeoutHandler(HandlerFunc(func(w ResponseWriter, r *Request) {
+		<-unblock
+	}), limit, "")
+	ts := httptest.NewUnstartedServer(h)
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HandlerTimeout: func(d time.Duration) {
+			got <- d
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusServiceUnavailable {
+		t.Errorf("status = %d; want %d", res.StatusCode, StatusServiceUnavailable)
+	}
+	select {
+	case d := <-got:
+		if d != limit {
+			t.Errorf("HandlerTimeout(%v); want %v", d, limit)
+		}
+	default:
+		t.Fatal("HandlerTimeout not called")
+	}
+}
+
+func TestServerTraceAsyncCopiesArgs(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	release := make(chan bool)
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("X-Foo", "before")
+		w.WriteHeader(StatusOK)
+		for i := 0; i < 10; i++ {
+			w.Header().Set("X-Foo", "after")
+			w.Header().Set(fmt.Sprintf("X-Bar-%d", i), "after")
+		}
+		close(release)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		WroteHeader: func(info httptrace.WroteHeaderInfo) {
+			<-release
+			got <- Header(info.Header).Get("X-Foo")
+		},
+		Async: true,
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case v := <-got:
+		if v != "before" {
+			t.Errorf("WroteHeader saw X-Foo = %q; want %q", v, "before")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WroteHeader not called")
+	}
+}
+
+func TestServerTraceChannelCopiesArgs(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	ch := make(chan httptrace.Event, 100)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("X-Foo", "before")
+		w.WriteHeader(StatusOK)
+		for i := 0; i < 10; i++ {
+			w.Header().Set("X-Foo", "after")
+			w.Header().Set(fmt.Sprintf("X-Bar-%d", i), "after")
+		}
+	}))
+	ts.Config.Trace = httptrace.NewChannelTrace(ch, httptrace.DropWhenFull)
+	ts.Start()
+	defer ts.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		res, err := ts.Client().Get(ts.URL)
+		if err == nil {
+			res.Body.Close()
+		}
+		done <- err
+	}()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-ch:
+			if ev.Name != httptrace.EventWroteHeader {
+				continue
+			}
+			h := Header(ev.Info.(httptrace.WroteHeaderInfo).Header)
+			if v := h.Get("X-Foo"); v != "before" {
+				t.Errorf("WroteHeader event has X-Foo = %q; want %q", v, "before")
+			}
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no WroteHeader event")
+		}
+	}
+}
+
+func TestServerTraceEnabled(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	var chunks, headers int32
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "hello")
+	}))
+	trace := &httptrace.ServerTrace{
+		WroteHeader: func(httptrace.WroteHeaderInfo) {
+			atomic.AddInt32(&headers, 1)
+		},
+		WroteBodyChunk: func(httptrace.WroteBodyChunkInfo) {
+			atomic.AddInt32(&chunks, 1)
+		},
+	}
+	ts.Config.Trace = trace
+	ts.Start()
+	defer ts.Close()
+
+	get := func() {
+		res, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	get()
+	if got := atomic.LoadInt32(&chunks); got != 1 {
+		t.Fatalf("WroteBodyChunk calls = %d; want 1", got)
+	}
+	trace.SetEnabled(httptrace.AllHooks &^ httptrace.BodyHooks)
+	get()
+	get()
+	if got := atomic.LoadInt32(&chunks); got != 1 {
+		t.Errorf("WroteBodyChunk calls with BodyHooks disabled = %d; want 1", got)
+	}
+	if got := atomic.LoadInt32(&headers); got != 3 {
+		t.Errorf("WroteHeader calls = %d; want 3", got)
+	}
+}
+
+func TestServerTraceReadFirstByte(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	accepted := make(chan time.Time, 1)
+	firstByte := make(chan time.Time, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.ConnState = func(c net.Conn, state ConnState) {
+		if state == StateNew {
+			accepted <- time.Now()
+		}
+	}
+	ts.Config.Trace = &httptrace.ServerTrace{
+		ReadFirstByte: func(t time.Time) {
+			firstByte <- t
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	const delay = 100 * time.Millisecond
+	time.Sleep(delay)
+	fmt.Fprintf(c, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+	if _, err := ReadResponse(bufio.NewReader(c), nil); err != nil {
+		t.Fatal(err)
+	}
+	if gap := (<-firstByte).Sub(<-accepted); gap < delay*3/4 {
+		t.Errorf("time from accept to first byte = %v; want at least %v", gap, delay)
+	}
+}
+
+func TestServerTraceSmugglingRejected(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.SmugglingInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.ErrorLog = quietLog
+	ts.Config.Trace = &httptrace.ServerTrace{
+		SmugglingRejected: func(info httptrace.SmugglingInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		headers string
+		reason  string
+	}{
+		{"Content-Length: 3\r\nContent-Length: 4\r\n", "multiple Content-Lengths"},
+		{"Content-Length: x\r\n", "invalid Content-Length"},
+		{"Transfer-Encoding: gzip\r\nContent-Length: 3\r\n", "unsupported Transfer-Encoding"},
+		{"Transfer-Encoding: chunked, chunked\r\n", "multiple Transfer-Encodings"},
+		{"Host: bar\r\nContent-Length: 3\r\n", "multiple Host headers"},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "POST / HTTP/1.1\r\nHost: foo\r\n%s\r\nabc", tt.headers)
+		res, err := ReadResponse(bufio.NewReader(c), nil)
+		c.Close()
+		if err != nil {
+			t.Fatalf("%q: %v", tt.headers, err)
+		}
+		if res.StatusCode != StatusBadRequest {
+			t.Errorf("%q: status = %d; want 400", tt.headers, res.StatusCode)
+		}
+		select {
+		case info := <-got:
+			if info.Reason != tt.reason {
+				t.Errorf("%q: Reason = %q; want %q", tt.headers, info.Reason, tt.reason)
+			}
+			if want := tt.reason == "multiple Host headers"; info.DuplicateHost != want {
+				t.Errorf("%q: DuplicateHost = %v; want %v", tt.headers, info.DuplicateHost, want)
+			}
+		default:
+			t.Errorf("%q: SmugglingRejected not called", tt.headers)
+		}
+	}
+}
+
+func TestServerTraceSniffedContentType(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "\x89PNG\x0D\x0A\x1A\x0A")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		SniffedContentType: func(ct string) {
+			got <- ct
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case ct := <-got:
+		if ct != "image/png" {
+			t.Errorf("SniffedContentType(%q); want %q", ct, "image/png")
+		}
+	default:
+		t.Fatal("SniffedContentType not called")
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "image/png" {
+		t.Errorf("Content-Type = %q; want %q", ct, "image/png")
+	}
+}
+
+func TestServerTraceConnectionReset(t *testing.T) {
+	switch runtime.GOOS {
+	case "nacl", "plan9", "windows":
+		t.Skipf("skipping on %s; relies on SO_LINGER to reset the connection", runtime.GOOS)
+	}
+	setParallel(t)
+	defer afterTest(t)
+	reset := make(chan bool, 2)
+	handlerDone := make(chan bool)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		defer close(handlerDone)
+		buf := make([]byte, 64<<10)
+		for {
+			if _, err := w.Write(buf); err != nil {
+				return
+			}
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		ConnectionReset: func() {
+			reset <- true
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+	if _, err := io.ReadFull(c, make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	// Close with a zero linger time so that the client sends a RST
+	// instead of a FIN.
+	c.(*net.TCPConn).SetLinger(0)
+	c.Close()
+
+	select {
+	case <-handlerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for handler to fail")
+	}
+	select {
+	case <-reset:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnectionReset not called")
+	}
+	select {
+	case <-reset:
+		t.Error("ConnectionReset called more than once")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Tests that writing to a connection the client closed with a FIN,
+// which fails with EPIPE, is not reported as a reset.
+func TestServerTraceConnectionResetAfterFIN(t *testing.T) {
+	switch runtime.GOOS {
+	case "nacl", "plan9":
+		t.Skipf("skipping on %s", runtime.GOOS)
+	}
+	setParallel(t)
+	defer afterTest(t)
+	reset := make(chan bool, 1)
+	closed := make(chan bool)
+	handlerErr := make(chan error, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		<-closed
+		// Give the FIN time to arrive.
+		time.Sleep(50 * time.Millisecond)
+		buf := make([]byte, 64<<10)
+		for {
+			if _, err := w.Write(buf); err != nil {
+				handlerErr <- err
+				return
+			}
+			w.(Flusher).Flush()
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		ConnectionReset: func() {
+			reset <- true
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+	// Close before any of the response arrives, so that the client
+	// sends a FIN, not a RST.
+	c.Close()
+	close(closed)
+
+	select {
+	case <-handlerErr:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for handler to fail")
+	}
+	select {
+	case <-reset:
+		t.Error("ConnectionReset called for a connection closed with a FIN")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestServerTraceConnSummary(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.ConnSummaryInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ioutil.ReadAll(r.Body)
+		switch r.URL.Path {
+		case "/missing":
+			NotFound(w, r)
+		case "/error":
+			Error(w, "oops", StatusInternalServerError)
+		default:
+			io.WriteString(w, "hello")
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		ConnSummary: func(info httptrace.ConnSummaryInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c := ts.Client()
+	var bytesWritten int64
+	for i, path := range []string{"/", "/missing", "/", "/error"} {
+		req, _ := NewRequest("POST", ts.URL+path, strings.NewReader("body"))
+		req.Close = i == 3
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, _ := io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		bytesWritten += n
+	}
+
+	var info httptrace.ConnSummaryInfo
+	select {
+	case info = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ConnSummary not called")
+	}
+	if info.Requests != 4 {
+		t.Errorf("Requests = %d; want 4", info.Requests)
+	}
+	if info.ErrorResponses != 2 {
+		t.Errorf("ErrorResponses = %d; want 2", info.ErrorResponses)
+	}
+	if info.BytesRead != 16 {
+		t.Errorf("BytesRead = %d; want 16", info.BytesRead)
+	}
+	if info.BytesWritten != bytesWritten {
+		t.Errorf("BytesWritten = %d; want %d", info.BytesWritten, bytesWritten)
+	}
+	if info.RemoteAddr == "" {
+		t.Error("RemoteAddr is empty")
+	}
+	if info.Duration <= 0 {
+		t.Errorf("Duration = %v; want > 0", info.Duration)
+	}
+}
+
+func TestServerTraceBodyLimitExceeded(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	const limit = 10
+	got := make(chan int64, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		body := MaxBytesReader(w, r.Body, limit)
+		if _, err := ioutil.ReadAll(body); err == nil {
+			t.Error("expected error reading body")
+		}
+		w.WriteHeader(StatusRequestEntityTooLarge)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		BodyLimitExceeded: func(limit int64) {
+			got <- limit
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL, "text/plain", strings.NewReader(strings.Repeat("a", 2*limit)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case n := <-got:
+		if n != limit {
+			t.Errorf("BodyLimitExceeded(%d); want %d", n, limit)
+		}
+	default:
+		t.Fatal("BodyLimitExceeded not called")
+	}
+}
+
+func TestServerTraceProtocolNegotiated(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan string, 1)
+	trace := &httptrace.ServerTrace{
+		ProtocolNegotiated: func(proto string) {
+			got <- proto
+		},
+	}
+	wantProto := func(want string) {
+		t.Helper()
+		select {
+		case proto := <-got:
+			if proto != want {
+				t.Errorf("ProtocolNegotiated(%q); want %q", proto, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("ProtocolNegotiated not called; want %q", want)
+		}
+	}
+	handler := HandlerFunc(func(w ResponseWriter, r *Request) {})
+
+	ts := httptest.NewUnstartedServer(handler)
+	ts.Config.Trace = trace
+	ts.TLS = &tls.Config{NextProtos: []string{"foo", "http/1.1"}}
+	ts.Config.TLSNextProto = map[string]func(*Server, *tls.Conn, Handler){
+		"foo": func(s *Server, c *tls.Conn, h Handler) {
+			c.Close()
+		},
+	}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// A client negotiating "foo" is handed to its TLSNextProto handler.
+	c, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		NextProtos:         []string{"foo"},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if proto := c.ConnectionState().NegotiatedProtocol; proto != "foo" {
+		t.Fatalf("client negotiated %q; want %q", proto, "foo")
+	}
+	wantProto("foo")
+
+	// A client without ALPN is served with HTTP/1.1.
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	wantProto("http/1.1")
+
+	ts2 := httptest.NewUnstartedServer(handler)
+	ts2.Config.Trace = trace
+	ts2.Start()
+	defer ts2.Close()
+	res, err = ts2.Client().Get(ts2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	wantProto("http/1.1")
+}
+
+func TestServerTraceChunkedRequestBody(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.RequestInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		ioutil.ReadAll(r.Body)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequest: func(info httptrace.RequestInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, chunked := range []bool{true, false} {
+		req, _ := NewRequest("POST", ts.URL, strings.NewReader("hello"))
+		if chunked {
+			req.ContentLength = -1
+			req.TransferEncoding = []string{"chunked"}
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if info := <-got; info.ChunkedRequestBody != chunked {
+			t.Errorf("ChunkedRequestBody = %v; want %v", info.ChunkedRequestBody, chunked)
+		}
+	}
+}
+
+func TestServerTraceWroteDate(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan time.Time, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "hello")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		WroteDate: func(now time.Time) {
+			got <- now
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	date, err := ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case wrote := <-got:
+		if d := wrote.Sub(date); d < 0 || d >= time.Second {
+			t.Errorf("WroteDate(%v) not within a second of Date %v", wrote, date)
+		}
+	default:
+		t.Fatal("WroteDate not called")
+	}
+}
+
+func TestServerTraceGotMethod(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	gotMethod := make(chan string, 1)
+	type rejection struct {
+		method string
+		code   int
+	}
+	rejected := make(chan rejection, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotMethod: func(method string) {
+			gotMethod <- method
+		},
+		MethodRejected: func(method string, code int) {
+			rejected <- rejection{method, code}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, method := range []string{"GET", "PROPFIND"} {
+		req, _ := NewRequest(method, ts.URL, nil)
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if got := <-gotMethod; got != method {
+			t.Errorf("GotMethod(%q); want %q", got, method)
+		}
+	}
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "G@T / HTTP/1.1\r\nHost: foo\r\n\r\n")
+	res, err := ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case r := <-rejected:
+		if r.method != "G@T" || r.code != res.StatusCode {
+			t.Errorf("MethodRejected(%q, %d); want (%q, %d)", r.method, r.code, "G@T", res.StatusCode)
+		}
+	default:
+		t.Fatal("MethodRejected not called")
+	}
+	select {
+	case m := <-gotMethod:
+		t.Errorf("GotMethod(%q) called for rejected method", m)
+	default:
+	}
+}
+
+func TestServerTraceWroteServerHeader(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	const server = "example/1.0"
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/server" {
+			w.Header().Set("Server", server)
+		}
+		io.WriteString(w, "hello")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		WroteServerHeader: func(v string) {
+			got <- v
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL + "/server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case v := <-got:
+		if v != server {
+			t.Errorf("WroteServerHeader(%q); want %q", v, server)
+		}
+	default:
+		t.Fatal("WroteServerHeader not called")
+	}
+
+	res, err = ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case v := <-got:
+		t.Errorf("WroteServerHeader(%q) called without a Server header", v)
+	default:
+	}
+}
+
+func TestServerTraceHandlerPanic(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		panicInHandler()
+	}))
+	ts.Config.ErrorLog = quietLog
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			got <- info
+		},
+		CapturePanicStack: true,
+	}
+	ts.Start()
+	defer ts.Close()
+
+	if _, err := ts.Client().Get(ts.URL); err == nil {
+		t.Fatal("expected error from panicking handler")
+	}
+	select {
+	case info := <-got:
+		if info.Panic != "boom" {
+			t.Errorf("Panic = %v; want %q", info.Panic, "boom")
+		}
+		if !strings.Contains(string(info.PanicStack), "panicInHandler") {
+			t.Errorf("PanicStack does not mention panicInHandler:\n%s", info.PanicStack)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandlerDone not called")
+	}
+}
+
+func TestServerTracePanicAfterCommit(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	committed := make(chan httptrace.PanicInfo, 2)
+	done := make(chan bool, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "partial")
+		if r.URL.Path == "/commit" {
+			w.(Flusher).Flush()
+			io.WriteString(w, "more")
+		}
+		panic("boom")
+	}))
+	ts.Config.ErrorLog = quietLog
+	ts.Config.Trace = &httptrace.ServerTrace{
+		PanicAfterCommit: func(info httptrace.PanicInfo) {
+			committed <- info
+		},
+		HandlerDone: func(httptrace.HandlerDoneInfo) {
+			done <- true
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, path := range []string{"/early", "/commit"} {
+		if res, err := ts.Client().Get(ts.URL + path); err == nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: HandlerDone not called", path)
+		}
+	}
+	select {
+	case info := <-committed:
+		if info.Value != "boom" {
+			t.Errorf("Value = %v; want %q", info.Value, "boom")
+		}
+		if info.StatusCode != StatusOK {
+			t.Errorf("StatusCode = %d; want %d", info.StatusCode, StatusOK)
+		}
+		if want := int64(len("partialmore")); info.BytesWritten != want {
+			t.Errorf("BytesWritten = %d; want %d", info.BytesWritten, want)
+		}
+	default:
+		t.Fatal("PanicAfterCommit not called")
+	}
+	select {
+	case info := <-committed:
+		t.Errorf("PanicAfterCommit called twice; second with %+v", info)
+	default:
+	}
+}
+
+func TestServerTraceHijackFailed(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan error, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		conn, _, err := w.(Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("first Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		if _, _, err := w.(Hijacker).Hijack(); err != ErrHijacked {
+			t.Errorf("second Hijack error = %v; want ErrHijacked", err)
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HijackFailed: func(err error) {
+			got <- err
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	if res, err := ts.Client().Get(ts.URL); err == nil {
+		res.Body.Close()
+	}
+	select {
+	case err := <-got:
+		if err != ErrHijacked {
+			t.Errorf("HijackFailed(%v); want ErrHijacked", err)
+		}
+	default:
+		t.Fatal("HijackFailed not called")
+	}
+	select {
+	case err := <-got:
+		t.Errorf("HijackFailed called twice; second with %v", err)
+	default:
+	}
+}
+
+func panicInHandler() {
+	panic("boom")
+}
+
+func TestServerTraceTLSHandshakeError(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan error, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.ErrorLog = quietLog
+	ts.Config.Trace = &httptrace.ServerTrace{
+		TLSHandshakeError: func(err error) {
+			got <- err
+		},
+	}
+	ts.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+
+	c, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{
+		MaxVersion:         tls.VersionTLS10,
+		InsecureSkipVerify: true,
+	})
+	if err == nil {
+		c.Close()
+		t.Fatal("expected handshake error")
+	}
+	select {
+	case err := <-got:
+		if err == nil {
+			t.Error("TLSHandshakeError(nil)")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("TLSHandshakeError not called")
+	}
+}
+
+func TestServerTraceHeaderSanitized(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type sanitized struct {
+		name, original string
+	}
+	got := make(chan sanitized, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("X-Ok", "fine")
+		w.Header().Set("X-Injected", "a\r\nSet-Cookie: evil=1")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HeaderSanitized: func(name, original string) {
+			got <- sanitized{name, original}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.Header.Get("Set-Cookie") != "" {
+		t.Fatal("header injection succeeded")
+	}
+	want := sanitized{"X-Injected", "a\r\nSet-Cookie: evil=1"}
+	select {
+	case s := <-got:
+		if s != want {
+			t.Errorf("HeaderSanitized(%q, %q); want (%q, %q)", s.name, s.original, want.name, want.original)
+		}
+	default:
+		t.Fatal("HeaderSanitized not called")
+	}
+	select {
+	case s := <-got:
+		t.Errorf("unexpected HeaderSanitized(%q, %q)", s.name, s.original)
+	default:
+	}
+}
+
+func TestServerTraceBufioPoolEvent(t *testing.T) {
+	defer afterTest(t)
+	var (
+		mu     sync.Mutex
+		counts = map[string]int{}
+		reused int
+	)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "hello")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		BufioPoolEvent: func(kind string, r bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			counts[kind]++
+			if r {
+				reused++
+			}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	// Each request is made on its own connection, which returns its
+	// buffers to the pools for the next connection to reuse.
+	const conns = 10
+	for i := 0; i < conns; i++ {
+		req, _ := NewRequest("GET", ts.URL, nil)
+		req.Close = true
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// One reader per connection; a writer per connection and one
+	// per response.
+	if counts["reader"] != conns || counts["writer"] != 2*conns {
+		t.Errorf("counts = %v; want %d readers and %d writers", counts, conns, 2*conns)
+	}
+	if reused == 0 {
+		t.Error("no pooled buffer reused")
+	}
+}
+
+func TestServerTraceGotQuery(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type query struct {
+		values map[string][]string
+		err    error
+	}
+	got := make(chan query, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotQuery: func(values map[string][]string, err error) {
+			got <- query{values, err}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		query   string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{"a=1&b=2", map[string][]string{"a": {"1"}, "b": {"2"}}, false},
+		{"a=%zz&b=2", map[string][]string{"b": {"2"}}, true},
+	} {
+		res, err := ts.Client().Get(ts.URL + "/?" + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		q := <-got
+		if !reflect.DeepEqual(q.values, tt.want) {
+			t.Errorf("%q: values = %v; want %v", tt.query, q.values, tt.want)
+		}
+		if (q.err != nil) != tt.wantErr {
+			t.Errorf("%q: err = %v; want error: %v", tt.query, q.err, tt.wantErr)
+		}
+	}
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case q := <-got:
+		t.Errorf("GotQuery(%v, %v) called without a query string", q.values, q.err)
+	default:
+	}
+}
+
+func TestServerTraceStatusChangeAttempt(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type change struct {
+		from, to int
+	}
+	got := make(chan change, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "partial")
+		w.WriteHeader(StatusOK)
+		w.WriteHeader(StatusInternalServerError)
+	}))
+	ts.Config.ErrorLog = quietLog
+	ts.Config.Trace = &httptrace.ServerTrace{
+		StatusChangeAttempt: func(from, to int) {
+			got <- change{from, to}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusOK {
+		t.Errorf("status = %d; want %d", res.StatusCode, StatusOK)
+	}
+	select {
+	case c := <-got:
+		if want := (change{StatusOK, StatusInternalServerError}); c != want {
+			t.Errorf("StatusChangeAttempt(%d, %d); want (%d, %d)", c.from, c.to, want.from, want.to)
+		}
+	default:
+		t.Fatal("StatusChangeAttempt not called")
+	}
+	select {
+	case c := <-got:
+		t.Errorf("unexpected StatusChangeAttempt(%d, %d)", c.from, c.to)
+	default:
+	}
+}
+
+func TestServerTraceGotCookie(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	var (
+		mu  sync.Mutex
+		got []string
+	)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotCookie: func(name, value string) {
+			mu.Lock()
+			got = append(got, name+"="+value)
+			mu.Unlock()
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	req, _ := NewRequest("GET", ts.URL, nil)
+	req.AddCookie(&Cookie{Name: "session", Value: "abc"})
+	req.AddCookie(&Cookie{Name: "theme", Value: "dark"})
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"session=abc", "theme=dark"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GotCookie calls = %q; want %q", got, want)
+	}
+}
+
+func TestServerTraceGotTraceContext(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type traceContext struct {
+		parent, state string
+	}
+	got := make(chan traceContext, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotTraceContext: func(traceparent, tracestate string) {
+			got <- traceContext{traceparent, tracestate}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	for _, state := range []string{"vendor=opaque", ""} {
+		req, _ := NewRequest("GET", ts.URL, nil)
+		req.Header.Set("Traceparent", parent)
+		if state != "" {
+			req.Header.Set("Tracestate", state)
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		select {
+		case tc := <-got:
+			if want := (traceContext{parent, state}); tc != want {
+				t.Errorf("GotTraceContext(%q, %q); want (%q, %q)", tc.parent, tc.state, want.parent, want.state)
+			}
+		default:
+			t.Fatal("GotTraceContext not called")
+		}
+	}
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case tc := <-got:
+		t.Errorf("GotTraceContext(%q, %q) called without a traceparent header", tc.parent, tc.state)
+	default:
+	}
+}
+
+func TestServerTraceTargetNormalized(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type normalization struct{ original, normalized string }
+	got := make(chan normalization, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		TargetNormalized: func(original, normalized string) {
+			got <- normalization{original, normalized}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET /a/b?x=%2e HTTP/1.1\r\nHost: foo\r\n\r\n"+
+		"GET /a/%2e%2e/b?x=1 HTTP/1.1\r\nHost: foo\r\nConnection: close\r\n\r\n")
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case n := <-got:
+		if want := (normalization{"/a/%2e%2e/b", "/a/../b"}); n != want {
+			t.Errorf("TargetNormalized(%q, %q); want (%q, %q)", n.original, n.normalized, want.original, want.normalized)
+		}
+	default:
+		t.Fatal("TargetNormalized not called")
+	}
+	select {
+	case n := <-got:
+		t.Errorf("TargetNormalized(%q, %q) called twice", n.original, n.normalized)
+	default:
+	}
+}
+
+func TestServerTraceGotAbsoluteURI(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan string, 2)
+	paths := make(chan string, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		paths <- r.URL.Path
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotAbsoluteURI: func(uri string) {
+			got <- uri
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	const uri = "http://example.com/path?x=1"
+	io.WriteString(c, "GET "+uri+" HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+		"GET /origin HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"/path", "/origin"} {
+		if path := <-paths; path != want {
+			t.Errorf("handler got path %q; want %q", path, want)
+		}
+	}
+	select {
+	case target := <-got:
+		if target != uri {
+			t.Errorf("GotAbsoluteURI(%q); want %q", target, uri)
+		}
+	default:
+		t.Fatal("GotAbsoluteURI not called")
+	}
+	select {
+	case target := <-got:
+		t.Errorf("GotAbsoluteURI(%q) called for an origin-form request", target)
+	default:
+	}
+}
+
+type missingContextKey struct{}
+
+func TestServerTraceGotContextKeys(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan []string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotContextKeys: func(present []string) {
+			got <- present
+		},
+		ContextKeys: map[string]interface{}{
+			"server":     ServerContextKey,
+			"local-addr": LocalAddrContextKey,
+			"missing":    missingContextKey{},
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if present, want := <-got, []string{"local-addr", "server"}; !reflect.DeepEqual(present, want) {
+		t.Errorf("GotContextKeys(%q); want %q", present, want)
+	}
+}
+
+func TestServerTraceGotAuthScheme(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotAuthScheme: func(scheme string) {
+			got <- scheme
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		auth, want string
+	}{
+		{"Bearer xyz", "Bearer"},
+		{"Basic dXNlcjpwYXNz", "Basic"},
+		{"Negotiate", "Negotiate"},
+		{"", ""},
+	} {
+		req, _ := NewRequest("GET", ts.URL, nil)
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		select {
+		case scheme := <-got:
+			if scheme != tt.want {
+				t.Errorf("Authorization %q: GotAuthScheme(%q); want %q", tt.auth, scheme, tt.want)
+			}
+		default:
+			if tt.want != "" {
+				t.Errorf("Authorization %q: GotAuthScheme not called", tt.auth)
+			}
+		}
+	}
+}
+
+func TestServerTraceAutoChunked(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan string, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		switch r.URL.Path {
+		case "/explicit":
+			w.Header().Set("Transfer-Encoding", "chunked")
+		case "/small":
+			io.WriteString(w, "hello")
+			return
+		}
+		io.WriteString(w, "hello")
+		w.(Flusher).Flush()
+		io.WriteString(w, "world")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		AutoChunked: func() {
+			got <- "called"
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/stream", true},
+		{"/explicit", false},
+		{"/small", false},
+	} {
+		res, err := ts.Client().Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if len(res.TransferEncoding) == 0 && tt.path != "/small" {
+			t.Errorf("%s: response not chunked", tt.path)
+		}
+		var called bool
+		select {
+		case <-got:
+			called = true
+		default:
+		}
+		if called != tt.want {
+			t.Errorf("%s: AutoChunked called = %v; want %v", tt.path, called, tt.want)
+		}
+	}
+}
+
+func TestServerTraceRequestDeadline(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.RequestInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequest: func(info httptrace.RequestInfo) {
+			got <- info
+		},
+	}
+	const timeout = time.Minute
+	ts.Config.WriteTimeout = timeout
+	ts.Start()
+	defer ts.Close()
+
+	before := time.Now()
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	info := <-got
+	if info.Deadline.Before(before.Add(timeout)) || info.Deadline.After(time.Now().Add(timeout)) {
+		t.Errorf("Deadline = %v; want about %v from now", info.Deadline, timeout)
+	}
+
+	ts2 := httptest.NewUnstartedServer(ts.Config.Handler)
+	ts2.Config.Trace = ts.Config.Trace
+	ts2.Start()
+	defer ts2.Close()
+	res, err = ts2.Client().Get(ts2.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if info := <-got; !info.Deadline.IsZero() {
+		t.Errorf("Deadline = %v without WriteTimeout; want zero", info.Deadline)
+	}
+}
+
+func TestServerTraceMethodNotAllowed(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan []string, 1)
+	getOnly := func(h Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, r *Request) {
+			if r.Method != "GET" {
+				w.Header().Set("Allow", "GET")
+				Error(w, "method not allowed", StatusMethodNotAllowed)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+	ts := httptest.NewUnstartedServer(getOnly(HandlerFunc(func(w ResponseWriter, r *Request) {})))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		MethodNotAllowed: func(allowed []string) {
+			got <- allowed
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL, "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case allowed := <-got:
+		if want := []string{"GET"}; !reflect.DeepEqual(allowed, want) {
+			t.Errorf("MethodNotAllowed(%q); want %q", allowed, want)
+		}
+	default:
+		t.Fatal("MethodNotAllowed not called")
+	}
+
+	res, err = ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case allowed := <-got:
+		t.Errorf("MethodNotAllowed(%q) called for an allowed method", allowed)
+	default:
+	}
+}
+
+func TestServerTraceDuplicateHeader(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type dup struct {
+		name   string
+		values []string
+	}
+	get := func(singleValue []string) []dup {
+		var mu sync.Mutex
+		var got []dup
+		ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+			w.Header().Add("Content-Type", "text/plain")
+			w.Header().Add("Content-Type", "text/html")
+			w.Header().Add("X-Foo", "a")
+			w.Header().Add("X-Foo", "b")
+		}))
+		ts.Config.Trace = &httptrace.ServerTrace{
+			DuplicateHeader: func(name string, values []string) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, dup{name, values})
+			},
+			SingleValueHeaders: singleValue,
+		}
+		ts.Start()
+		defer ts.Close()
+
+		res, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		return got
+	}
+
+	want := []dup{{"Content-Type", []string{"text/plain", "text/html"}}}
+	if got := get(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("DuplicateHeader calls = %v; want %v", got, want)
+	}
+	want = []dup{{"X-Foo", []string{"a", "b"}}}
+	if got := get([]string{"x-foo"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("with SingleValueHeaders, DuplicateHeader calls = %v; want %v", got, want)
+	}
+}
+
+func TestServerTraceConditionalResult(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.ConditionalInfo, 1)
+	modtime := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Etag", `"v1"`)
+		ServeContent(w, r, "foo.txt", modtime, strings.NewReader("hello"))
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		ConditionalResult: func(info httptrace.ConditionalInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		header, value string
+		want          httptrace.ConditionalInfo
+	}{
+		{"If-None-Match", `"v1"`, httptrace.ConditionalInfo{
+			Evaluated:  []string{"If-None-Match"},
+			StatusCode: StatusNotModified,
+		}},
+		{"If-None-Match", `"v0"`, httptrace.ConditionalInfo{
+			Evaluated: []string{"If-None-Match"},
+		}},
+		{"If-Match", `"v0"`, httptrace.ConditionalInfo{
+			Evaluated:  []string{"If-Match"},
+			StatusCode: StatusPreconditionFailed,
+		}},
+		{"If-Modified-Since", modtime.Format(TimeFormat), httptrace.ConditionalInfo{
+			Evaluated:  []string{"If-Modified-Since"},
+			StatusCode: StatusNotModified,
+		}},
+	} {
+		req, _ := NewRequest("GET", ts.URL, nil)
+		req.Header.Set(tt.header, tt.value)
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if want := tt.want.StatusCode; want != 0 && res.StatusCode != want {
+			t.Errorf("%s: status = %d; want %d", tt.header, res.StatusCode, want)
+		}
+		select {
+		case info := <-got:
+			if !reflect.DeepEqual(info, tt.want) {
+				t.Errorf("%s: ConditionalResult(%+v); want %+v", tt.header, info, tt.want)
+			}
+		default:
+			t.Errorf("%s: ConditionalResult not called", tt.header)
+		}
+	}
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case info := <-got:
+		t.Errorf("ConditionalResult(%+v) called for unconditional request", info)
+	default:
+	}
+}
+
+func TestServerTraceIfRangeEvaluated(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan bool, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Etag", `"v1"`)
+		ServeContent(w, r, "foo.txt", time.Time{}, strings.NewReader("hello"))
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		IfRangeEvaluated: func(satisfied bool) {
+			got <- satisfied
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		ifRange    string
+		wantStatus int
+		wantBody   string
+	}{
+		{`"v1"`, StatusPartialContent, "ell"},
+		{`"v0"`, StatusOK, "hello"},
+	} {
+		req, _ := NewRequest("GET", ts.URL, nil)
+		req.Header.Set("Range", "bytes=1-3")
+		req.Header.Set("If-Range", tt.ifRange)
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.wantStatus || string(body) != tt.wantBody {
+			t.Errorf("If-Range %s: got %d %q; want %d %q", tt.ifRange, res.StatusCode, body, tt.wantStatus, tt.wantBody)
+		}
+		select {
+		case satisfied := <-got:
+			if want := tt.wantStatus == StatusPartialContent; satisfied != want {
+				t.Errorf("If-Range %s: IfRangeEvaluated(%v); want %v", tt.ifRange, satisfied, want)
+			}
+		default:
+			t.Errorf("If-Range %s: IfRangeEvaluated not called", tt.ifRange)
+		}
+	}
+}
+
+func TestServerTraceQueueWait(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	const (
+		queueDelay   = 50 * time.Millisecond
+		handlerDelay = 30 * time.Millisecond
+	)
+	got := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		time.Sleep(handlerDelay)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequest: func(httptrace.RequestInfo) {
+			// Delay the handler.
+			time.Sleep(queueDelay)
+		},
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	info := <-got
+	if info.QueueWait < queueDelay {
+		t.Errorf("QueueWait = %v; want at least %v", info.QueueWait, queueDelay)
+	}
+	if info.HandlerExecution < handlerDelay {
+		t.Errorf("HandlerExecution = %v; want at least %v", info.HandlerExecution, handlerDelay)
+	}
+	if sum := info.QueueWait + info.HandlerExecution; sum > info.Duration {
+		t.Errorf("QueueWait + HandlerExecution = %v; want at most Duration %v", sum, info.Duration)
+	}
+}
+
+func TestServerTraceRedirected(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.RedirectInfo, 1)
+	mux := NewServeMux()
+	mux.HandleFunc("/old", func(w ResponseWriter, r *Request) {
+		Redirect(w, r, "/new", StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/dir/", func(w ResponseWriter, r *Request) {})
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.Trace = &httptrace.ServerTrace{
+		Redirected: func(info httptrace.RedirectInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c := ts.Client()
+	c.CheckRedirect = func(*Request, []*Request) error {
+		return ErrUseLastResponse
+	}
+	for _, tt := range []struct {
+		path     string
+		location string
+		code     int
+	}{
+		{"/old", "/new", StatusTemporaryRedirect},
+		{"/dir", "/dir/", StatusMovedPermanently},
+	} {
+		res, err := c.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		select {
+		case info := <-got:
+			if info.Location != tt.location || info.StatusCode != tt.code {
+				t.Errorf("%s: Redirected(%q, %d); want (%q, %d)", tt.path, info.Location, info.StatusCode, tt.location, tt.code)
+			}
+		default:
+			t.Errorf("%s: Redirected not called", tt.path)
+		}
+	}
+}
+
+func TestServerTraceZeroCopyUsed(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	for _, tls := range []bool{false, true} {
+		got := make(chan bool, 1)
+		ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+			ServeFile(w, r, "testdata/file")
+		}))
+		ts.Config.Trace = &httptrace.ServerTrace{
+			ZeroCopyUsed: func(used bool) {
+				got <- used
+			},
+		}
+		if tls {
+			ts.StartTLS()
+		} else {
+			ts.Start()
+		}
+		res, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			ts.Close()
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		ts.Close()
+
+		// Only plaintext connections on systems whose TCP
+		// connections implement ReadFrom with sendfile copy
+		// files in the kernel.
+		want := !tls && ExportSendfileSupported
+		select {
+		case used := <-got:
+			if used != want {
+				t.Errorf("TLS=%v: ZeroCopyUsed(%v); want %v", tls, used, want)
+			}
+		default:
+			t.Errorf("TLS=%v: ZeroCopyUsed not called", tls)
+		}
+	}
+}
+
+func TestServerTraceRawHeaderOrder(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	gotReq := make(chan httptrace.RequestInfo, 2)
+	bodies := make(chan string, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		CaptureHeaderOrder: true,
+		GotRequest: func(info httptrace.RequestInfo) {
+			gotReq <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// Two pipelined requests, to check that recording the first
+	// request's header does not consume any of the second.
+	io.WriteString(c, "POST / HTTP/1.1\r\nx-lower: a\r\nHost: foo\r\nX-Folded: a\r\n b\r\nCONTENT-LENGTH: 5\r\nx-lower: b\r\n\r\nhello"+
+		"POST / HTTP/1.1\r\nHost: foo\r\nContent-Length: 5\r\nConnection: close\r\n\r\nworld")
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		t.Fatal(err)
+	}
+
+	wantOrders := [][]string{
+		{"x-lower", "Host", "X-Folded", "CONTENT-LENGTH", "x-lower"},
+		{"Host", "Content-Length", "Connection"},
+	}
+	for i, wantBody := range []string{"hello", "world"} {
+		select {
+		case info := <-gotReq:
+			if !info.CanonicalHeaders {
+				t.Errorf("request %d: CanonicalHeaders = false; want true", i)
+			}
+			if !reflect.DeepEqual(info.RawHeaderOrder, wantOrders[i]) {
+				t.Errorf("request %d: RawHeaderOrder = %q; want %q", i, info.RawHeaderOrder, wantOrders[i])
+			}
+		default:
+			t.Fatalf("request %d: GotRequest not called", i)
+		}
+		if body := <-bodies; body != wantBody {
+			t.Errorf("request %d: body = %q; want %q", i, body, wantBody)
+		}
+	}
+}
+
+func TestServerTraceResponseTruncated(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	const size = 64 << 20
+	type truncation struct{ written, expected int64 }
+	got := make(chan truncation, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		chunk := make([]byte, 32<<10)
+		for n := 0; n < size; n += len(chunk) {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		ResponseTruncated: func(written, expected int64) {
+			got <- truncation{written, expected}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: foo\r\n\r\n")
+	if _, err := io.ReadFull(c, make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	select {
+	case tr := <-got:
+		if tr.expected != size {
+			t.Errorf("expected = %d; want %d", tr.expected, size)
+		}
+		if tr.written <= 0 || tr.written >= size {
+			t.Errorf("bytesWritten = %d; want between 0 and %d", tr.written, size)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("ResponseTruncated not called")
+	}
+}
+
+func TestServerTraceHeadBodyDiscarded(t *testing.T) {
+	defer afterTest(t)
+	const size = 10 << 10
+	got := make(chan int64, 2)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, strings.Repeat("x", size))
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		HeadBodyDiscarded: func(n int64) { got <- n },
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, method := range []string{"HEAD", "GET"} {
+		req, _ := NewRequest(method, ts.URL, nil)
+		res, err := DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+	select {
+	case n := <-got:
+		if n != size {
+			t.Errorf("HeadBodyDiscarded(%d); want %d", n, size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("HeadBodyDiscarded not called")
+	}
+	select {
+	case n := <-got:
+		t.Errorf("HeadBodyDiscarded(%d) called for GET request", n)
+	default:
+	}
+}
+
+var peakHeapSink []byte
+
+func TestServerTracePeakHeapDelta(t *testing.T) {
+	defer afterTest(t)
+	defer func() { peakHeapSink = nil }()
+	const size = 64 << 20
+	got := make(chan httptrace.HandlerDoneInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		// Keep the allocation live until HandlerDone.
+		peakHeapSink = make([]byte, size)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		MeasurePeakHeap: true,
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if info := <-got; info.PeakHeapDelta < size/2 {
+		t.Errorf("PeakHeapDelta = %d; want at least %d", info.PeakHeapDelta, size/2)
+	}
+}
+
+func TestServerTraceRawRequestLine(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	long := "GET /" + strings.Repeat("a", 5000) + " HTTP/1.1"
+	lines := []string{
+		"GET /a/./b/../%7Ec;p?q=1&q=2 HTTP/1.1",
+		"GET http://foo/x//y HTTP/1.1",
+		long,
+	}
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequest: func(info httptrace.RequestInfo) {
+			got <- info.RawRequestLine
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, line := range lines {
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, line+"\r\nHost: foo\r\nConnection: close\r\n\r\n")
+		io.Copy(ioutil.Discard, c)
+		c.Close()
+
+		want := line
+		if len(want) > 4096 {
+			want = want[:4096]
+		}
+		select {
+		case raw := <-got:
+			if raw != want {
+				t.Errorf("RawRequestLine = %.80q; want %.80q", raw, want)
+			}
+		default:
+			t.Errorf("GotRequest not called for %.80q", line)
+		}
+	}
+}
+
+func TestServerTracePathCleaned(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type cleaned struct{ original, cleaned string }
+	got := make(chan cleaned, 1)
+	mux := NewServeMux()
+	mux.HandleFunc("/a/c", func(w ResponseWriter, r *Request) {})
+	ts := httptest.NewUnstartedServer(mux)
+	ts.Config.Trace = &httptrace.ServerTrace{
+		PathCleaned: func(original, path string) {
+			got <- cleaned{original, path}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "GET /a//b/../c HTTP/1.1\r\nHost: foo\r\nConnection: close\r\n\r\n")
+	res, err := ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusMovedPermanently {
+		t.Errorf("status = %d; want %d", res.StatusCode, StatusMovedPermanently)
+	}
+	select {
+	case p := <-got:
+		if want := (cleaned{"/a//b/../c", "/a/c"}); p != want {
+			t.Errorf("PathCleaned(%q, %q); want (%q, %q)", p.original, p.cleaned, want.original, want.cleaned)
+		}
+	default:
+		t.Fatal("PathCleaned not called")
+	}
+
+	res, err = ts.Client().Get(ts.URL + "/a/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case p := <-got:
+		t.Errorf("PathCleaned(%q, %q) called for a clean path", p.original, p.cleaned)
+	default:
+	}
+}
+
+func TestServerTraceGotResponsePrefix(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		if r.URL.Path == "/large" {
+			io.WriteString(w, strings.Repeat("x", 100))
+			io.WriteString(w, strings.Repeat("y", 100))
+			return
+		}
+		Error(w, "no such widget", StatusNotFound)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		CaptureResponseBody: 64,
+		GotResponsePrefix: func(b []byte) {
+			got <- string(b)
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	for _, tt := range []struct{ path, want string }{
+		{"/", "no such widget\n"},
+		{"/large", strings.Repeat("x", 64)},
+	} {
+		res, err := ts.Client().Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		select {
+		case prefix := <-got:
+			if prefix != tt.want {
+				t.Errorf("%s: GotResponsePrefix(%q); want %q", tt.path, prefix, tt.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: GotResponsePrefix not called", tt.path)
+		}
+	}
+}
+
+func TestServerTraceNoContentLength(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.NoContentLengthInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "hello")
+		if r.URL.Path == "/stream" {
+			w.(Flusher).Flush()
+			io.WriteString(w, "world")
+		}
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		NoContentLength: func(info httptrace.NoContentLengthInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	get := func(path string) {
+		res, err := ts.Client().Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+
+	get("/stream")
+	select {
+	case info := <-got:
+		if info.Method != "GET" || info.StatusCode != StatusOK || info.Framing != "chunked" {
+			t.Errorf("NoContentLength(%+v); want GET, 200, chunked", info)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("NoContentLength not called for streaming response")
+	}
+
+	// A small response gets a Content-Length from the server.
+	get("/")
+	select {
+	case info := <-got:
+		t.Errorf("NoContentLength(%+v) called for response with a Content-Length", info)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServerTraceConnContext(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	// Per-connection state, keyed by the connection's context.
+	var mu sync.Mutex
+	requests := make(map[context.Context]int)
+	counts := make(chan int, 3)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequest: func(info httptrace.RequestInfo) {
+			if info.ConnContext.Value(LocalAddrContextKey) == nil {
+				t.Error("ConnContext has no LocalAddrContextKey value")
+			}
+			mu.Lock()
+			requests[info.ConnContext]++
+			n := requests[info.ConnContext]
+			mu.Unlock()
+			counts <- n
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	c1 := dial()
+	defer c1.Close()
+	io.WriteString(c1, "GET / HTTP/1.1\r\nHost: foo\r\n\r\nGET / HTTP/1.1\r\nHost: foo\r\nConnection: close\r\n\r\n")
+	io.Copy(ioutil.Discard, c1)
+	c2 := dial()
+	defer c2.Close()
+	io.WriteString(c2, "GET / HTTP/1.1\r\nHost: foo\r\nConnection: close\r\n\r\n")
+	io.Copy(ioutil.Discard, c2)
+
+	var got []int
+	for i := 0; i < 3; i++ {
+		got = append(got, <-counts)
+	}
+	if want := []int{1, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("per-connection request counts = %v; want %v", got, want)
+	}
+}
+
+func TestServerTraceEffectiveDeadline(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	tests := []struct {
+		readTimeout, handlerTimeout time.Duration
+		want                        []string
+	}{
+		{time.Hour, time.Minute, []string{"ReadTimeout", "TimeoutHandler"}},
+		{time.Minute, time.Hour, []string{"ReadTimeout"}},
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var got []string
+		start := time.Now()
+		ts := httptest.NewUnstartedServer(TimeoutHandler(HandlerFunc(func(w ResponseWriter, r *Request) {}), tt.handlerTimeout, ""))
+		ts.Config.ReadTimeout = tt.readTimeout
+		ts.Config.Trace = &httptrace.ServerTrace{
+			EffectiveDeadline: func(info httptrace.DeadlineSourceInfo) {
+				want := tt.readTimeout
+				if info.Source == "TimeoutHandler" {
+					want = tt.handlerTimeout
+				}
+				if d := info.Deadline.Sub(start); d < want || d > want+time.Minute {
+					t.Errorf("%s deadline is %v after start; want about %v", info.Source, d, want)
+				}
+				mu.Lock()
+				got = append(got, info.Source)
+				mu.Unlock()
+			},
+		}
+		ts.Start()
+		res, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			ts.Close()
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		ts.Close()
+
+		mu.Lock()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ReadTimeout %v, TimeoutHandler %v: EffectiveDeadline sources = %q; want %q", tt.readTimeout, tt.handlerTimeout, got, tt.want)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestServerTracePipelined(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan bool, 3)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.WriteString(w, "ok")
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequest: func(info httptrace.RequestInfo) {
+			got <- info.Pipelined
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	readResponse := func() {
+		res, err := ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}
+	const req = "GET / HTTP/1.1\r\nHost: foo\r\n\r\n"
+	io.WriteString(c, req+req)
+	readResponse()
+	readResponse()
+	io.WriteString(c, req)
+	readResponse()
+
+	for i, want := range []bool{false, true, false} {
+		if p := <-got; p != want {
+			t.Errorf("request %d: Pipelined = %v; want %v", i, p, want)
+		}
+	}
+}
+
+func TestServerTraceBodyReadComplete(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	type complete struct {
+		clean bool
+		total int64
+	}
+	got := make(chan complete, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		BodyReadComplete: func(clean bool, total int64) {
+			got <- complete{clean, total}
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		name, req string
+		want      complete
+	}{
+		{
+			name: "complete",
+			req:  "POST / HTTP/1.1\r\nHost: foo\r\nContent-Length: 5\r\nConnection: close\r\n\r\nhello",
+			want: complete{true, 5},
+		},
+		{
+			name: "chunked",
+			req:  "POST / HTTP/1.1\r\nHost: foo\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			want: complete{true, 5},
+		},
+		{
+			name: "truncated",
+			req:  "POST / HTTP/1.1\r\nHost: foo\r\nContent-Length: 10\r\n\r\nhello",
+			want: complete{false, 5},
+		},
+	}
+	for _, tt := range tests {
+		c, err := net.Dial("tcp", ts.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, tt.req)
+		if tt.want.clean {
+			io.Copy(ioutil.Discard, c)
+		} else {
+			c.(*net.TCPConn).CloseWrite()
+		}
+		select {
+		case bc := <-got:
+			if bc != tt.want {
+				t.Errorf("%s: BodyReadComplete(%v, %d); want (%v, %d)", tt.name, bc.clean, bc.total, tt.want.clean, tt.want.total)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: BodyReadComplete not called", tt.name)
+		}
+		c.Close()
+	}
+}
+
+func TestServerTraceGotRequestTrailers(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan map[string][]string, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		io.Copy(ioutil.Discard, r.Body)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotRequestTrailers: func(trailer map[string][]string) {
+			got <- trailer
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "POST / HTTP/1.1\r\nHost: foo\r\nTransfer-Encoding: chunked\r\nTrailer: Grpc-Status\r\nConnection: close\r\n\r\n"+
+		"5\r\nhello\r\n0\r\nGrpc-Status: 0\r\n\r\n")
+	io.Copy(ioutil.Discard, c)
+	select {
+	case trailer := <-got:
+		if want := map[string][]string{"Grpc-Status": {"0"}}; !reflect.DeepEqual(trailer, want) {
+			t.Errorf("GotRequestTrailers(%v); want %v", trailer, want)
+		}
+	default:
+		t.Error("GotRequestTrailers not called")
+	}
+}
+
+func TestServerTraceGotServerOptions(t *testing.T) {
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan bool, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {
+		t.Errorf("handler called for %s %s", r.Method, r.RequestURI)
+	}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		GotServerOptions: func() {
+			got <- true
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "OPTIONS * HTTP/1.1\r\nHost: foo\r\n\r\n")
+	res, err := ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != StatusOK {
+		t.Errorf("status = %d; want 200", res.StatusCode)
+	}
+	select {
+	case <-got:
+	default:
+		t.Error("GotServerOptions not called")
+	}
+}
+
+func TestServerTraceSocketOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("socket options are not traced on %s", runtime.GOOS)
+	}
+	setParallel(t)
+	defer afterTest(t)
+	got := make(chan httptrace.SocketOptionsInfo, 1)
+	ts := httptest.NewUnstartedServer(HandlerFunc(func(w ResponseWriter, r *Request) {}))
+	ts.Config.Trace = &httptrace.ServerTrace{
+		SocketOptions: func(info httptrace.SocketOptionsInfo) {
+			got <- info
+		},
+	}
+	ts.Start()
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	select {
+	case info := <-got:
+		// Go enables TCP_NODELAY on all TCP connections.
+		if !info.NoDelay {
+			t.Error("NoDelay = false; want true")
+		}
+		if info.ReadBuffer <= 0 || info.WriteBuffer <= 0 {
+			t.Errorf("ReadBuffer, WriteBuffer = %d, %d; want positive sizes", info.ReadBuffer, info.WriteBuffer)
+		}
+		if info.RemoteAddr == "" {
+			t.Error("RemoteAddr is empty")
+		}
+	default:
+		t.Fatal("SocketOptions not called")
+	}
+}
+
+func TestTraceHandler(t *testing.T) {
+	defer afterTest(t)
+	events := make(chan string, 16)
+	trace := &httptrace.ServerTrace{
+		Name: "sampled",
+		WroteHeader: func(httptrace.WroteHeaderInfo) {
+			events <- "WroteHeader"
+		},
+		WroteBodyChunk: func(httptrace.WroteBodyChunkInfo) {
+			events <- "WroteBodyChunk"
+		},
+		HandlerDone: func(info httptrace.HandlerDoneInfo) {
+			if info.ID == 0 || info.StatusCode != StatusOK || info.BytesWritten != int64(len("sampled")) {
+				t.Errorf("HandlerDone(%+v) for a sampled request", info)
+			}
+			events <- "HandlerDone"
+		},
+	}
+	h := HandlerFunc(func(w ResponseWriter, r *Request) {
+		if ct := httptrace.ContextServerTrace(r.Context()); ct != nil {
+			io.WriteString(w, ct.Name)
+		}
+	})
+	sample := func(r *Request) bool { return r.URL.Query().Get("trace") == "1" }
+	ts := httptest.NewServer(TraceHandler(h, trace, sample))
+	defer ts.Close()
+
+	for _, tt := range []struct {
+		query string
+		want  string
+	}{
+		{"?trace=1", "sampled"},
+		{"?trace=0", ""},
+		{"", ""},
+		{"?trace=1", "sampled"},
+	} {
+		res, err := Get(ts.URL + tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != tt.want {
+			t.Errorf("GET %q: trace = %q; want %q", tt.query, body, tt.want)
+		}
+		if tt.want == "" {
+			continue
+		}
+		var got []string
+		for len(got) < 3 {
+			select {
+			case ev := <-events:
+				got = append(got, ev)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("GET %q: hooks called = %q; want 3", tt.query, got)
+			}
+		}
+		if want := []string{"WroteHeader", "WroteBodyChunk", "HandlerDone"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("GET %q: hooks called = %q; want %q", tt.query, got, want)
+		}
+	}
+	if n := len(events); n != 0 {
+		t.Errorf("%d hooks called for requests that were not sampled", n)
+	}
+}
@@ -7,6 +7,8 @@ package http
 import (
 	"bytes"
 	"encoding/binary"
+	"io"
+	"net/http/httptrace"
 )
 
 // The algorithm uses at most sniffLen bytes to make its decision.
@@ -37,6 +39,56 @@ func DetectContentType(data []byte) string {
 	return "application/octet-stream" // fallback
 }
 
+// SniffingBody returns a ReadCloser that reads r.Body. On its first
+// Read, it reads up to the first 512 bytes of the body, determines
+// their content type with DetectContentType and calls the
+// GotRequestBodyType hook of the ServerTrace in r's context, if any.
+// Handlers that detect the type of uploads from their contents may
+// replace r.Body with it to make the result visible to tracing.
+// The hook is not called for an empty body.
+func SniffingBody(r *Request) io.ReadCloser {
+	return &sniffingBody{body: r.Body, trace: httptrace.ContextServerTrace(r.Context())}
+}
+
+type sniffingBody struct {
+	body    io.ReadCloser
+	trace   *httptrace.ServerTrace
+	sniffed bool
+	buf     []byte // sniffed bytes not yet returned by Read
+	err     error  // error reading the sniffed bytes
+}
+
+func (b *sniffingBody) Read(p []byte) (int, error) {
+	if !b.sniffed {
+		b.sniffed = true
+		buf := make([]byte, sniffLen)
+		n, err := io.ReadFull(b.body, buf)
+		b.buf = buf[:n]
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		b.err = err
+		if n > 0 {
+			if trace := traceHooks(b.trace, httptrace.BodyHooks); trace != nil && trace.GotRequestBodyType != nil {
+				trace.GotRequestBodyType(DetectContentType(b.buf))
+			}
+		}
+	}
+	if len(b.buf) > 0 {
+		n := copy(p, b.buf)
+		b.buf = b.buf[n:]
+		return n, nil
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	return b.body.Read(p)
+}
+
+func (b *sniffingBody) Close() error {
+	return b.body.Close()
+}
+
 func isWS(b byte) bool {
 	switch b {
 	case '\t', '\n', '\x0c', '\r', ' ':
@@ -0,0 +1,48 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http
+
+import (
+	"net"
+	"net/http/httptrace"
+	"syscall"
+	"time"
+)
+
+// socketOptions returns the socket options in effect for c, if c is a
+// TCP connection, or wraps one and provides its SyscallConn method, as
+// the connections of httptrace.NewLimitListener do.
+func socketOptions(c net.Conn) (info httptrace.SocketOptionsInfo, ok bool) {
+	sc, isSyscallConn := c.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !isSyscallConn {
+		return info, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return info, false
+	}
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		get := func(level, opt int) int {
+			v, err := syscall.GetsockoptInt(int(fd), level, opt)
+			if err != nil && serr == nil {
+				serr = err
+			}
+			return v
+		}
+		info.NoDelay = get(syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0
+		info.KeepAlive = get(syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0
+		info.KeepAliveInterval = time.Duration(get(syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL)) * time.Second
+		info.ReadBuffer = get(syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		info.WriteBuffer = get(syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil || serr != nil {
+		return info, false
+	}
+	info.RemoteAddr = c.RemoteAddr().String()
+	return info, true
+}
@@ -0,0 +1,18 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux
+
+package http
+
+import (
+	"net"
+	"net/http/httptrace"
+)
+
+// socketOptions returns the socket options in effect for c. Reading
+// them is only implemented on Linux.
+func socketOptions(c net.Conn) (info httptrace.SocketOptionsInfo, ok bool) {
+	return info, false
+}
@@ -568,13 +568,13 @@ func (t *transferReader) fixTransferEncoding() error {
 			break
 		}
 		if encoding != "chunked" {
-			return &badStringError{"unsupported transfer encoding", encoding}
+			return &framingError{"unsupported Transfer-Encoding", &badStringError{"unsupported transfer encoding", encoding}}
 		}
 		te = te[0 : len(te)+1]
 		te[len(te)-1] = encoding
 	}
 	if len(te) > 1 {
-		return &badStringError{"too many transfer encodings", strings.Join(te, ",")}
+		return &framingError{"multiple Transfer-Encodings", &badStringError{"too many transfer encodings", strings.Join(te, ",")}}
 	}
 	if len(te) > 0 {
 		// RFC 7230 3.3.2 says "A sender MUST NOT send a
@@ -601,6 +601,17 @@ func (t *transferReader) fixTransferEncoding() error {
 	return nil
 }
 
+// A framingError is an error reading a message whose Content-Length
+// or Transfer-Encoding headers make its framing ambiguous, or a
+// request with more than one Host header. On a request, this may
+// indicate an attempt at request smuggling.
+type framingError struct {
+	reason string // short description of the ambiguity
+	err    error
+}
+
+func (e *framingError) Error() string { return e.err.Error() }
+
 // Determine the expected body length, using RFC 2616 Section 4.4. This
 // function is not a method, because ultimately it should be shared by
 // ReadResponse and ReadRequest.
@@ -617,7 +628,7 @@ func fixLength(isResponse bool, status int, requestMethod string, header Header,
 		first := strings.TrimSpace(contentLens[0])
 		for _, ct := range contentLens[1:] {
 			if first != strings.TrimSpace(ct) {
-				return 0, fmt.Errorf("http: message cannot contain multiple Content-Length headers; got %q", contentLens)
+				return 0, &framingError{"multiple Content-Lengths", fmt.Errorf("http: message cannot contain multiple Content-Length headers; got %q", contentLens)}
 			}
 		}
 
@@ -635,7 +646,7 @@ func fixLength(isResponse bool, status int, requestMethod string, header Header,
 		// methods which don't permit bodies. As an exception, allow
 		// exactly one Content-Length header if its value is "0".
 		if isRequest && len(contentLens) > 0 && !(len(contentLens) == 1 && contentLens[0] == "0") {
-			return 0, fmt.Errorf("http: method cannot contain a Content-Length; got %q", contentLens)
+			return 0, &framingError{"unexpected Content-Length", fmt.Errorf("http: method cannot contain a Content-Length; got %q", contentLens)}
 		}
 		return 0, nil
 	}
@@ -660,7 +671,7 @@ func fixLength(isResponse bool, status int, requestMethod string, header Header,
 	if cl != "" {
 		n, err := parseContentLength(cl)
 		if err != nil {
-			return -1, err
+			return -1, &framingError{"invalid Content-Length", err}
 		}
 		return n, nil
 	} else {
@@ -754,6 +765,24 @@ type body struct {
 	closed     bool
 	earlyClose bool   // Close called and we didn't read to the end of src
 	onHitEOF   func() // if non-nil, func to call when EOF is Read
+	nread      int64  // bytes read from src
+
+	// onReadStall, if non-nil, is called with the number of
+	// bytes read so far when a Read of src blocks for longer
+	// than stallThreshold. It is only used by the server.
+	onReadStall    func(int64)
+	stallThreshold time.Duration
+
+	// onReadDone, if non-nil, is called once with the number of
+	// bytes read when reading src ends, reporting whether it
+	// ended at a clean EOF rather than with an error such as
+	// io.ErrUnexpectedEOF. It is only used by the server.
+	onReadDone func(clean bool, n int64)
+
+	// onTrailer, if non-nil, is called with the trailer fields
+	// read after a chunked body, if there are any. It is only
+	// used by the server.
+	onTrailer func(Header)
 }
 
 // ErrBodyReadAfterClose is returned when reading a Request or Response
@@ -776,7 +805,15 @@ func (b *body) readLocked(p []byte) (n int, err error) {
 	if b.sawEOF {
 		return 0, io.EOF
 	}
-	n, err = b.src.Read(p)
+	if b.onReadStall != nil {
+		nread := b.nread
+		stall := time.AfterFunc(b.stallThreshold, func() { b.onReadStall(nread) })
+		n, err = b.src.Read(p)
+		stall.Stop()
+	} else {
+		n, err = b.src.Read(p)
+	}
+	b.nread += int64(n)
 
 	if err == io.EOF {
 		b.sawEOF = true
@@ -816,6 +853,10 @@ func (b *body) readLocked(p []byte) (n int, err error) {
 	if b.sawEOF && b.onHitEOF != nil {
 		b.onHitEOF()
 	}
+	if b.onReadDone != nil && (b.sawEOF || err != nil) {
+		b.onReadDone(b.sawEOF && (err == nil || err == io.EOF), b.nread)
+		b.onReadDone = nil
+	}
 
 	return n, err
 }
@@ -881,6 +922,9 @@ func (b *body) readTrailer() error {
 	case *Response:
 		mergeSetHeader(&rr.Trailer, Header(hdr))
 	}
+	if b.onTrailer != nil && len(hdr) > 0 {
+		b.onTrailer(Header(hdr))
+	}
 	return nil
 }
 